@@ -1,3 +1,5 @@
 module github.com/Brayzonn/deploy-agent
 
 go 1.25.7
+
+require gopkg.in/yaml.v3 v3.0.1
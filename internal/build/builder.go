@@ -1,11 +1,14 @@
 package build
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Brayzonn/deploy-agent/internal/logger"
@@ -13,34 +16,208 @@ import (
 )
 
 type Builder struct {
-	workDir string
-	log     *logger.Logger
+	ctx            context.Context
+	workDir        string
+	pipeline       *types.Pipeline
+	packageManager *PackageManager
+	node           *Node
+	installCache   *InstallCache
+	cleanInstall   bool
+	log            *logger.Logger
 }
 
 func New(workDir string, log *logger.Logger) *Builder {
 	return &Builder{
-		workDir: workDir,
-		log:     log,
+		ctx:      context.Background(),
+		workDir:  workDir,
+		pipeline: &types.Pipeline{},
+		log:      log,
 	}
 }
 
+// SetPipeline replaces the built-in install, build and output detection with a declared pipeline
+func (b *Builder) SetPipeline(pipeline *types.Pipeline) {
+	b.pipeline = pipeline
+}
+
+// SetNode builds with a Node install other than the node on the PATH
+func (b *Builder) SetNode(node *Node) {
+	b.node = node
+}
+
+// SetContext kills the build's commands when ctx is cancelled, such as when a build running alongside fails
+func (b *Builder) SetContext(ctx context.Context) {
+	b.ctx = ctx
+}
+
+// a command of the build, killed together with everything it started when the build is cancelled
+func (b *Builder) exec(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(b.ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd
+}
+
+// run a command line of the pipeline through the shell in the work directory
+func (b *Builder) shell(commandLine string) *exec.Cmd {
+	cmd := b.exec("sh", "-c", commandLine)
+	cmd.Dir = b.workDir
+	cmd.Env = b.env()
+	return cmd
+}
+
+// the package manager of the work directory, detected once and checked to be installed
+func (b *Builder) detectPackageManager() (*PackageManager, error) {
+	if b.packageManager != nil {
+		return b.packageManager, nil
+	}
+
+	pm, err := DetectPackageManager(b.workDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := pm.CheckInstalled(b.node); err != nil {
+		return nil, err
+	}
+
+	b.packageManager = pm
+	return pm, nil
+}
+
+// run a tool of the Node install, such as npm or a package manager installed with it
+func (b *Builder) command(args []string) (*exec.Cmd, error) {
+	path, err := b.node.lookPath(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s is not installed: %w", args[0], err)
+	}
+
+	cmd := b.exec(path, args[1:]...)
+	cmd.Dir = b.workDir
+	cmd.Env = b.env()
+	return cmd, nil
+}
+
+// environment of every build command, the pipeline's env on top of the agent's and the Node install's
+func (b *Builder) env() []string {
+	env := append(os.Environ(), b.node.Env()...)
+	for name, value := range b.pipeline.Env {
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+// SetInstallCache skips installs whose lock file, dependencies and Node version have not
+// changed since the last one, clean removes node_modules and installs regardless
+func (b *Builder) SetInstallCache(cache *InstallCache, clean bool) {
+	b.installCache = cache
+	b.cleanInstall = clean
+}
+
 // Install Dependencies 
 func (b *Builder) InstallDependencies() error {
 	b.log.Info("Installing dependencies...")
 
+	pm, err := DetectPackageManager(b.workDir)
+	if err != nil {
+		return err
+	}
 
-	lockFile := filepath.Join(b.workDir, "package-lock.json")
-	var cmd *exec.Cmd
-	
-	if _, err := os.Stat(lockFile); err == nil {
-		b.log.Info("Using npm ci (lock file found)...")
-		cmd = exec.Command("npm", "ci", "--prefer-offline", "--no-audit")
-	} else {
-		b.log.Info("Using npm install (no lock file)...")
-		cmd = exec.Command("npm", "install")
+	clean := b.cleanInstall
+	command := b.pipeline.Install
+	if command == "" {
+		if pm, err = b.detectPackageManager(); err != nil {
+			return err
+		}
+		command = strings.Join(pm.InstallArgs(), " ")
 	}
 
-	cmd.Dir = b.workDir
+	hash := ""
+	if b.installCache != nil {
+		// The other half of a fullstack repository may be installing into the same workspace
+		unlock := b.installCache.lock(pm.Dir)
+		defer unlock()
+
+		if b.installCache.installedDir(pm.Dir) {
+			if b.pipeline.Install == "" {
+				b.log.Infof("Dependencies in %s were already installed by this deployment, skipping install", pm.Dir)
+				return nil
+			}
+			// node_modules was cleaned and installed moments ago, and may be in use by the other build
+			clean = false
+		}
+
+		if hash, err = installHash(b.workDir, pm, command, b.node); err != nil {
+			return err
+		}
+
+		if hash != "" && !clean && installIntact(pm) {
+			previous, err := b.installCache.Get(b.workDir)
+			if err != nil {
+				b.log.Warningf("%v", err)
+			}
+			if previous == hash {
+				b.log.Infof("Dependencies unchanged since the last install (%s), skipping install", hash[:12])
+				return nil
+			}
+		}
+
+		// A failed install leaves node_modules half written, the next one must not be skipped
+		if err := b.installCache.Put(b.workDir, ""); err != nil {
+			b.log.Warningf("%v", err)
+		}
+	}
+
+	if clean {
+		b.log.Infof("Clean install requested, removing %s", filepath.Join(pm.Dir, "node_modules"))
+		if err := os.RemoveAll(filepath.Join(pm.Dir, "node_modules")); err != nil {
+			return fmt.Errorf("failed to remove node_modules: %w", err)
+		}
+	}
+
+	if err := b.install(pm); err != nil {
+		return err
+	}
+
+	if b.installCache != nil {
+		b.installCache.markInstalled(pm.Dir)
+	}
+	if hash != "" {
+		if err := b.installCache.Put(b.workDir, hash); err != nil {
+			b.log.Warningf("%v", err)
+		}
+	}
+	return nil
+}
+
+// run the pipeline's install command, or the package manager's install
+func (b *Builder) install(pm *PackageManager) error {
+	if b.pipeline.Install != "" {
+		b.log.Infof("Running install command: %s", b.pipeline.Install)
+		output, err := b.shell(b.pipeline.Install).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to install dependencies: %w\nOutput: %s", err, string(output))
+		}
+		b.log.Success("Dependencies installed successfully")
+		return nil
+	}
+
+	args := pm.InstallArgs()
+	switch {
+	case pm.LockFile == "":
+		b.log.Infof("Using %s (no lock file)...", strings.Join(args, " "))
+	case pm.Dir != b.workDir:
+		b.log.Infof("Using %s (workspace lock file %s)...", strings.Join(args, " "), pm.LockFile)
+	default:
+		b.log.Infof("Using %s (%s found)...", strings.Join(args, " "), filepath.Base(pm.LockFile))
+	}
+
+	cmd, err := b.command(args)
+	if err != nil {
+		return err
+	}
+	cmd.Dir = pm.Dir
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to install dependencies: %w\nOutput: %s", err, string(output))
@@ -71,22 +248,36 @@ func (b *Builder) ScriptExists(scriptName string) (bool, error) {
     return exists, nil
 }
 
-// RunBuild runs the npm build script
+// RunBuild runs the build script with the project's package manager
 func (b *Builder) RunBuild() (*types.BuildOutput, error) {
 	b.log.Info("Building application...")
 	startTime := time.Now()
 
-	// Check if build script exists
-	exists, err := b.ScriptExists("build")
-	if err != nil {
-		return nil, err
-	}
-	if !exists {
-		return nil, fmt.Errorf("no 'build' script found in package.json")
-	}
+	var cmd *exec.Cmd
+	if b.pipeline.Build != "" {
+		b.log.Infof("Running build command: %s", b.pipeline.Build)
+		cmd = b.shell(b.pipeline.Build)
+	} else {
+		// Check if build script exists
+		exists, err := b.ScriptExists("build")
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("no 'build' script found in package.json")
+		}
 
-	cmd := exec.Command("npm", "run", "build")
-	cmd.Dir = b.workDir
+		pm, err := b.detectPackageManager()
+		if err != nil {
+			return nil, err
+		}
+
+		args := pm.RunArgs("build")
+		b.log.Infof("Running %s", strings.Join(args, " "))
+		if cmd, err = b.command(args); err != nil {
+			return nil, err
+		}
+	}
 	
 	output, err := cmd.CombinedOutput()
 	duration := time.Since(startTime)
@@ -101,19 +292,12 @@ func (b *Builder) RunBuild() (*types.BuildOutput, error) {
 	}
 
 	// Detect build output directory
-	outputDir := ""
-	distPath := filepath.Join(b.workDir, "dist")
-	buildPath := filepath.Join(b.workDir, "build")
-
-	if _, err := os.Stat(distPath); err == nil {
-		outputDir = distPath
-	} else if _, err := os.Stat(buildPath); err == nil {
-		outputDir = buildPath
-	} else {
+	outputDir := b.findOutputDir()
+	if outputDir == "" {
 		return &types.BuildOutput{
 			Success:  false,
 			Duration: duration,
-			Error:    fmt.Errorf("no build output directory found (dist/build missing)"),
+			Error:    fmt.Errorf("no build output directory found (%s missing)", strings.Join(b.outputDirs(), "/")),
 		}, fmt.Errorf("no build output found")
 	}
 
@@ -128,6 +312,60 @@ func (b *Builder) RunBuild() (*types.BuildOutput, error) {
 	}, nil
 }
 
+// directories the build may write its output to, in order of preference
+func (b *Builder) outputDirs() []string {
+	if b.pipeline.OutputDir != "" {
+		return []string{b.pipeline.OutputDir}
+	}
+	return []string{"dist", "build"}
+}
+
+// return the first output directory the build created, empty when there is none
+func (b *Builder) findOutputDir() string {
+	for _, dir := range b.outputDirs() {
+		path := filepath.Join(b.workDir, dir)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// Verify runs the test commands of the pipeline with their output in the deployment log,
+// the first one that fails stops the deployment before anything goes live
+func (b *Builder) Verify() error {
+	if len(b.pipeline.Test) == 0 {
+		return nil
+	}
+
+	b.log.Info("Running tests...")
+	startTime := time.Now()
+
+	for _, test := range b.pipeline.Test {
+		b.log.Infof("Running test command: %s", test)
+
+		cmd := b.shell(test)
+		// Test runners such as jest and vitest wait for input in watch mode unless they run in CI
+		if _, set := b.pipeline.Env["CI"]; !set {
+			cmd.Env = append(cmd.Env, "CI=true")
+		}
+
+		output, err := cmd.CombinedOutput()
+		for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+			if line != "" {
+				b.log.Infof("  [test] %s", line)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("test command %q failed: %w", test, err)
+		}
+	}
+
+	b.log.Successf("Tests passed in %v", time.Since(startTime).Round(time.Millisecond))
+	return nil
+}
+
 //  check if the build output directory exists and is not empty
 func (b *Builder) ValidateBuildOutput(outputDir string) error {
 	info, err := os.Stat(outputDir)
@@ -170,22 +408,18 @@ func (b *Builder) WaitForBuildCompletion(timeout time.Duration) (string, error)
         case <-ticker.C:
             elapsed := time.Since(startTime)
             
-            distPath := filepath.Join(b.workDir, "dist")
-            if _, err := os.Stat(distPath); err == nil {
+            if outputDir := b.findOutputDir(); outputDir != "" {
                 b.log.Successf("Build directory found after %v", elapsed)
-                return distPath, nil
-            }
-
-            buildPath := filepath.Join(b.workDir, "build")
-            if _, err := os.Stat(buildPath); err == nil {
-                b.log.Successf("Build directory found after %v", elapsed)
-                return buildPath, nil
+                return outputDir, nil
             }
 
             b.log.Infof("Waiting for build to complete... (%v elapsed)", elapsed.Round(time.Second))
 
         case <-timeoutChan:  
             return "", fmt.Errorf("build timeout: directory not created after %v", timeout)
+
+        case <-b.ctx.Done():
+            return "", fmt.Errorf("build cancelled: %w", b.ctx.Err())
         }
     }
 }
\ No newline at end of file
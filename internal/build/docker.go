@@ -5,18 +5,30 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/Brayzonn/deploy-agent/internal/logger"
 	"github.com/Brayzonn/deploy-agent/pkg/types"
+	"gopkg.in/yaml.v3"
 )
 
+// rollbackRepository prefixes the tags kept of images that were running before a deploy
+const rollbackRepository = "deploy-agent"
+
 type DockerBuilder struct {
     workDir       string
     composeFile   string
     envFile       string
     log           *logger.Logger
+
+    // project and env are set for compose projects that must not share the directory's default project
+    project string
+    env     []string
+
+    // service name to the tagged image it ran before this deploy
+    rollbackImages map[string]string
 }
 
 func NewDockerBuilder(workDir, composeFile, envFile string, log *logger.Logger) *DockerBuilder {
@@ -35,6 +47,28 @@ func NewDockerBuilder(workDir, composeFile, envFile string, log *logger.Logger)
     }
 }
 
+// SetProject runs every compose command in its own project with extra environment variables
+func (d *DockerBuilder) SetProject(project string, env []string) {
+	d.project = project
+	d.env = env
+}
+
+// build a docker-compose command for the builder's compose file and project
+func (d *DockerBuilder) compose(args ...string) *exec.Cmd {
+	composeArgs := []string{}
+	if d.project != "" {
+		composeArgs = append(composeArgs, "-p", d.project)
+	}
+	composeArgs = append(composeArgs, "-f", d.composeFile)
+
+	cmd := exec.Command("docker-compose", append(composeArgs, args...)...)
+	cmd.Dir = d.workDir
+	if d.env != nil {
+		cmd.Env = append(os.Environ(), d.env...)
+	}
+	return cmd
+}
+
 func (d *DockerBuilder) Build() (*types.BuildOutput, error) {
     d.log.Info("Building Docker containers...")
     startTime := time.Now()
@@ -48,8 +82,7 @@ func (d *DockerBuilder) Build() (*types.BuildOutput, error) {
 		d.log.Warningf("Env file not found: %s", d.envFile)
 	
 	}
-    cmd := exec.Command("docker-compose", "-f", d.composeFile, "build")
-    cmd.Dir = d.workDir
+    cmd := d.compose("build")
 
     output, err := cmd.CombinedOutput()
     duration := time.Since(startTime)
@@ -78,15 +111,13 @@ func (d *DockerBuilder) Deploy() error {
     d.log.Info("Deploying Docker containers...")
 
     d.log.Info("Stopping existing containers...")
-    stopCmd := exec.Command("docker-compose", "-f", d.composeFile, "down", "--remove-orphans")
-    stopCmd.Dir = d.workDir
+    stopCmd := d.compose("down", "--remove-orphans")
     if err := stopCmd.Run(); err != nil {
         d.log.Warning("Failed to stop containers (may not exist yet)")
     }
 
     d.log.Info("Starting containers...")
-    cmd := exec.Command("docker-compose", "-f", d.composeFile, "up", "-d", "--build")
-    cmd.Dir = d.workDir
+    cmd := d.compose("up", "-d", "--build")
 
     output, err := cmd.CombinedOutput()
     if err != nil {
@@ -113,9 +144,8 @@ func (d *DockerBuilder) RunMigrations(migrationCmd string) error {
 
     parts := strings.Fields(migrationCmd)
     
-    cmd := exec.Command("docker-compose", "-f", d.composeFile, "exec", "-T", "api")
+    cmd := d.compose("exec", "-T", "api")
     cmd.Args = append(cmd.Args, parts...)
-    cmd.Dir = d.workDir
 
     output, err := cmd.CombinedOutput()
     if err != nil {
@@ -128,8 +158,7 @@ func (d *DockerBuilder) RunMigrations(migrationCmd string) error {
 }
 
 func (d *DockerBuilder) CheckHealth() error {
-    cmd := exec.Command("docker-compose", "-f", d.composeFile, "ps")
-    cmd.Dir = d.workDir
+    cmd := d.compose("ps")
 
     output, err := cmd.CombinedOutput()
     if err != nil {
@@ -148,7 +177,7 @@ func (d *DockerBuilder) CheckHealth() error {
 }
 
 func (d *DockerBuilder) GetLogs(service string, tail int) (string, error) {
-    args := []string{"-f", d.composeFile, "logs"}
+    args := []string{"logs"}
     if service != "" {
         args = append(args, service)
     }
@@ -156,8 +185,7 @@ func (d *DockerBuilder) GetLogs(service string, tail int) (string, error) {
         args = append(args, "--tail", fmt.Sprintf("%d", tail))
     }
 
-    cmd := exec.Command("docker-compose", args...)
-    cmd.Dir = d.workDir
+    cmd := d.compose(args...)
 
     output, err := cmd.CombinedOutput()
     if err != nil {
@@ -167,16 +195,175 @@ func (d *DockerBuilder) GetLogs(service string, tail int) (string, error) {
     return string(output), nil
 }
 
+// TagRunningImages tags the image of every running service as <deploy-agent>/<app>-<service>:<tag> so Rollback can go back to it
+func (d *DockerBuilder) TagRunningImages(appName, tag string) error {
+	d.rollbackImages = map[string]string{}
+
+	psCmd := d.compose("ps", "-q")
+	output, err := psCmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	containerIDs := strings.Fields(string(output))
+	if len(containerIDs) == 0 {
+		d.log.Info("No running containers, nothing to tag for rollback")
+		return nil
+	}
+
+	inspectArgs := append([]string{"inspect", "--format",
+		`{{.State.Running}} {{index .Config.Labels "com.docker.compose.service"}} {{.Image}}`}, containerIDs...)
+	output, err = exec.Command("docker", inspectArgs...).Output()
+	if err != nil {
+		return fmt.Errorf("failed to inspect containers: %w", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "true" {
+			continue
+		}
+		service, imageID := fields[1], fields[2]
+
+		image := fmt.Sprintf("%s/%s-%s:%s", rollbackRepository, strings.ToLower(appName), service, tag)
+		if output, err := exec.Command("docker", "tag", imageID, image).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to tag image of %s: %w\nOutput: %s", service, err, string(output))
+		}
+
+		d.rollbackImages[service] = image
+		d.log.Infof("Tagged running image of %s as %s", service, image)
+	}
+
+	d.pruneRollbackTags(appName, tag)
+	return nil
+}
+
+// remove the rollback tags of older deploys so their images can be garbage collected
+func (d *DockerBuilder) pruneRollbackTags(appName, keepTag string) {
+	cmd := exec.Command("docker", "images", "--format", "{{.Repository}}:{{.Tag}}",
+		"--filter", fmt.Sprintf("reference=%s/%s-*", rollbackRepository, strings.ToLower(appName)))
+	output, err := cmd.Output()
+	if err != nil {
+		return
+	}
+
+	for _, image := range strings.Fields(string(output)) {
+		if strings.HasSuffix(image, ":"+keepTag) {
+			continue
+		}
+		// Images still used by a container keep existing, only the tag goes away
+		exec.Command("docker", "rmi", image).Run()
+	}
+}
+
+// Rollback brings the stack back up on the images tagged before this deploy and checks it is healthy
 func (d *DockerBuilder) Rollback() error {
     d.log.Warning("Rolling back Docker deployment...")
 
-    cmd := exec.Command("docker-compose", "-f", d.composeFile, "down")
-    cmd.Dir = d.workDir
+    if len(d.rollbackImages) == 0 {
+        d.log.Warning("No images were running before this deploy, stopping the failed containers")
+
+        cmd := d.compose("down", "--remove-orphans")
+
+        if err := cmd.Run(); err != nil {
+            return fmt.Errorf("rollback failed: %w", err)
+        }
+        return fmt.Errorf("no previous images to roll back to")
+    }
+
+    overridePath, err := d.writeRollbackOverride()
+    if err != nil {
+        return err
+    }
+    defer os.Remove(overridePath)
+
+    cmd := d.compose("-f", overridePath, "up", "-d", "--no-build", "--force-recreate", "--remove-orphans")
 
-    if err := cmd.Run(); err != nil {
-        return fmt.Errorf("rollback failed: %w", err)
+    output, err := cmd.CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("failed to start previous containers: %w\nOutput: %s", err, string(output))
+    }
+
+    d.log.Info("Waiting for previous containers to be healthy...")
+    time.Sleep(10 * time.Second)
+
+    if err := d.CheckHealth(); err != nil {
+        return fmt.Errorf("previous version is not healthy: %w", err)
     }
 
     d.log.Success("Rollback completed")
     return nil
-}
\ No newline at end of file
+}
+
+// read the version key of the compose file, empty when it has none
+func (d *DockerBuilder) composeVersion() string {
+	data, err := os.ReadFile(filepath.Join(d.workDir, d.composeFile))
+	if err != nil {
+		return ""
+	}
+
+	var compose struct {
+		Version string `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return ""
+	}
+
+	return compose.Version
+}
+
+// write a compose override that pins every service that was running to its tagged image
+func (d *DockerBuilder) writeRollbackOverride() (string, error) {
+	services := make([]string, 0, len(d.rollbackImages))
+	for service := range d.rollbackImages {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	var override strings.Builder
+	// docker-compose v1 refuses to merge files with different versions
+	if version := d.composeVersion(); version != "" {
+		fmt.Fprintf(&override, "version: %q\n", version)
+	}
+	override.WriteString("services:\n")
+	for _, service := range services {
+		fmt.Fprintf(&override, "  %s:\n    image: %s\n", service, d.rollbackImages[service])
+	}
+
+	file, err := os.CreateTemp("", "deploy-agent-rollback-*.yml")
+	if err != nil {
+		return "", fmt.Errorf("failed to write rollback override: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(override.String()); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write rollback override: %w", err)
+	}
+
+	return file.Name(), nil
+}
+
+// Remove stops the compose project and deletes its containers, networks and volumes
+func (d *DockerBuilder) Remove() error {
+	d.log.Info("Removing Docker containers and volumes...")
+
+	output, err := d.compose("down", "--volumes", "--remove-orphans").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove containers: %w\nOutput: %s", err, string(output))
+	}
+
+	return nil
+}
+
+// Status returns the container listing of the compose project
+func (d *DockerBuilder) Status() (string, error) {
+	cmd := d.compose("ps")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to check container status: %w\nOutput: %s", err, string(output))
+	}
+
+	return string(output), nil
+}
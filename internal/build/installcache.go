@@ -0,0 +1,231 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InstallCache remembers what the last install of each directory of a deployment target was
+// done from, so an install with nothing new to install can be skipped
+type InstallCache struct {
+	path string
+	// mu keeps builds running at the same time from writing over each other's entries
+	mu sync.Mutex
+
+	// installs into one directory never overlap, the halves of a fullstack repository in one
+	// workspace share its node_modules, and each directory is installed once per deployment
+	dirsMu    sync.Mutex
+	dirs      map[string]*sync.Mutex
+	installed map[string]bool
+}
+
+// installState is the last successful install of a directory
+type installState struct {
+	Hash        string    `json:"hash"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// NewInstallCache keeps the install hashes of a deployment target under the state directory
+func NewInstallCache(stateDir, target string) *InstallCache {
+	return &InstallCache{
+		path: filepath.Join(stateDir, "installs", target+".json"),
+	}
+}
+
+func (c *InstallCache) read() (map[string]installState, error) {
+	states := map[string]installState{}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return states, nil
+		}
+		return nil, fmt.Errorf("failed to read install cache: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("failed to parse install cache: %w", err)
+	}
+	return states, nil
+}
+
+// Get returns the hash of the last successful install in dir, empty when there was none
+func (c *InstallCache) Get(dir string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	states, err := c.read()
+	if err != nil {
+		return "", err
+	}
+	return states[dir].Hash, nil
+}
+
+// Put records a successful install in dir, an empty hash forgets the directory
+func (c *InstallCache) Put(dir, hash string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	states, err := c.read()
+	if err != nil {
+		return err
+	}
+
+	if hash == "" {
+		delete(states, dir)
+	} else {
+		states[dir] = installState{Hash: hash, InstalledAt: time.Now()}
+	}
+
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode install cache: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("failed to create install cache directory: %w", err)
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", c.path, os.Getpid())
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write install cache: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write install cache: %w", err)
+	}
+
+	return nil
+}
+
+// lock waits for any other install into dir and holds it until the returned func is called
+func (c *InstallCache) lock(dir string) func() {
+	c.dirsMu.Lock()
+	if c.dirs == nil {
+		c.dirs = map[string]*sync.Mutex{}
+	}
+	mu, ok := c.dirs[dir]
+	if !ok {
+		mu = &sync.Mutex{}
+		c.dirs[dir] = mu
+	}
+	c.dirsMu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// whether dir was already installed by this deployment, only asked while holding its lock
+func (c *InstallCache) installedDir(dir string) bool {
+	c.dirsMu.Lock()
+	defer c.dirsMu.Unlock()
+	return c.installed[dir]
+}
+
+// remember that dir was installed by this deployment
+func (c *InstallCache) markInstalled(dir string) {
+	c.dirsMu.Lock()
+	defer c.dirsMu.Unlock()
+	if c.installed == nil {
+		c.installed = map[string]bool{}
+	}
+	c.installed[dir] = true
+}
+
+// Remove forgets every directory of the deployment target
+func (c *InstallCache) Remove() error {
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove install cache: %w", err)
+	}
+	return nil
+}
+
+// package.json fields that change what an install puts in node_modules
+var dependencyFields = []string{
+	"dependencies", "devDependencies", "optionalDependencies", "peerDependencies",
+	"bundleDependencies", "overrides", "resolutions", "pnpm", "workspaces",
+}
+
+// installHash covers everything an install depends on: the lock file, the dependency fields of
+// package.json, the command that installs and the Node version native modules are built for.
+// It is empty when there is no lock file, an install without one can resolve newer versions
+func installHash(workDir string, pm *PackageManager, command string, node *Node) (string, error) {
+	if pm.LockFile == "" {
+		return "", nil
+	}
+
+	lock, err := os.ReadFile(pm.LockFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", filepath.Base(pm.LockFile), err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(workDir, "package.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read package.json: %w", err)
+	}
+
+	var pkg map[string]json.RawMessage
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return "", fmt.Errorf("failed to parse package.json: %w", err)
+	}
+
+	hash := sha256.New()
+	hash.Write(lock)
+	for _, field := range dependencyFields {
+		// Re-encoding drops formatting, only what the field says counts
+		value := []byte("null")
+		if raw, ok := pkg[field]; ok {
+			var decoded interface{}
+			if err := json.Unmarshal(raw, &decoded); err != nil {
+				return "", fmt.Errorf("failed to parse package.json: %w", err)
+			}
+			value, _ = json.Marshal(decoded)
+		}
+		fmt.Fprintf(hash, "\n%s=%s", field, value)
+	}
+	fmt.Fprintf(hash, "\ninstall=%s\nnode=%s", command, nodeVersion(node))
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// the version of the Node install, asking the node on the PATH when the project did not pick one
+func nodeVersion(node *Node) string {
+	if node != nil && node.Version != "" {
+		return node.Version
+	}
+
+	path, err := node.lookPath("node")
+	if err != nil {
+		return ""
+	}
+	output, _ := exec.Command(path, "--version").Output()
+	return strings.TrimSpace(string(output))
+}
+
+// whether the install of a previous deployment is still in place, judged by the file each
+// package manager writes when an install completes
+func installIntact(pm *PackageManager) bool {
+	marker := filepath.Join("node_modules", ".package-lock.json")
+	switch {
+	case pm.Name == "pnpm":
+		marker = filepath.Join("node_modules", ".modules.yaml")
+	case pm.Name == "yarn" && pm.Berry:
+		// Plug'n'Play installs have no node_modules
+		marker = filepath.Join(".yarn", "install-state.gz")
+	case pm.Name == "yarn":
+		marker = filepath.Join("node_modules", ".yarn-integrity")
+	case pm.Name == "bun":
+		marker = "node_modules"
+	}
+
+	_, err := os.Stat(filepath.Join(pm.Dir, marker))
+	return err == nil
+}
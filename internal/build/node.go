@@ -0,0 +1,601 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Node managers whose installs the agent can pick a version from
+const (
+	NodeManagerNone  = ""
+	NodeManagerNVM   = "nvm"
+	NodeManagerFNM   = "fnm"
+	NodeManagerVolta = "volta"
+	NodeManagerDir   = "dir"
+)
+
+// Node is the Node.js install a project is built and run with
+type Node struct {
+	// Version is the installed version, such as 18.19.0
+	Version string
+	// BinDir holds its node, npm and globally installed tools, empty for the node on the PATH
+	BinDir string
+	// Required is the version the project asked for and Source the file that asked
+	Required string
+	Source   string
+}
+
+// RequiredNodeVersion reads the Node version a project asks for from .nvmrc, .node-version or
+// package.json's engines.node. Like nvm, a version file of a parent directory up to the
+// checkout's root counts. Both are empty when the project does not ask for a version
+func RequiredNodeVersion(dir string) (spec, source string, err error) {
+	if spec, source := nodeVersionFile(dir); spec != "" {
+		return spec, source, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", fmt.Errorf("failed to read package.json: %w", err)
+	}
+	if err == nil {
+		var pkg struct {
+			Engines struct {
+				Node string `json:"node"`
+			} `json:"engines"`
+		}
+		if err := json.Unmarshal(data, &pkg); err != nil {
+			return "", "", fmt.Errorf("failed to parse package.json: %w", err)
+		}
+		if pkg.Engines.Node != "" {
+			return strings.TrimSpace(pkg.Engines.Node), filepath.Join(dir, "package.json"), nil
+		}
+	}
+
+	for current := dir; ; {
+		if _, err := os.Stat(filepath.Join(current, ".git")); err == nil || filepath.Dir(current) == current {
+			return "", "", nil
+		}
+		current = filepath.Dir(current)
+
+		if spec, source := nodeVersionFile(current); spec != "" {
+			return spec, source, nil
+		}
+	}
+}
+
+// the version in a directory's .nvmrc or .node-version, without comments and blank lines
+func nodeVersionFile(dir string) (spec, source string) {
+	for _, name := range []string{".nvmrc", ".node-version"} {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			if line = strings.TrimSpace(line); line != "" {
+				return line, path
+			}
+		}
+	}
+	return "", ""
+}
+
+// ResolveNode picks the newest Node install of the version manager that satisfies the version
+// the project in dir asks for. Without a manager the node on the PATH must satisfy it. A project
+// that asks for no version gets the node on the PATH
+func ResolveNode(dir, manager, versionsDir string) (*Node, error) {
+	spec, source, err := RequiredNodeVersion(dir)
+	if err != nil {
+		return nil, err
+	}
+	if spec == "" || spec == "system" {
+		return &Node{}, nil
+	}
+
+	installs, err := nodeInstalls(manager, versionsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]string, 0, len(installs))
+	for version := range installs {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(parseVersion(versions[i]), parseVersion(versions[j])) > 0
+	})
+
+	matches, err := nodeSpecMatcher(spec, func() (ltsReleases, error) {
+		return listLTS(manager, versionsDir)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+
+	for _, version := range versions {
+		if matches(parseVersion(version)) {
+			return &Node{Version: version, BinDir: installs[version], Required: spec, Source: source}, nil
+		}
+	}
+
+	installed := "none"
+	if len(versions) > 0 {
+		installed = "v" + strings.Join(versions, ", v")
+	}
+	return nil, fmt.Errorf("%s asks for node %s but no installed version matches (%s: %s)%s",
+		source, spec, managerName(manager), installed, installHint(manager, spec))
+}
+
+// the installed versions of a manager and their bin directories
+func nodeInstalls(manager, versionsDir string) (map[string]string, error) {
+	home, _ := os.UserHomeDir()
+	installs := map[string]string{}
+
+	switch manager {
+	case NodeManagerNone:
+		output, err := exec.Command("node", "--version").Output()
+		if err != nil {
+			return installs, nil
+		}
+		installs[strings.TrimPrefix(strings.TrimSpace(string(output)), "v")] = ""
+		return installs, nil
+
+	case NodeManagerNVM:
+		return scanNodeInstalls(filepath.Join(nvmDir(versionsDir), "versions", "node"), "bin")
+
+	case NodeManagerFNM:
+		return scanNodeInstalls(filepath.Join(fnmDir(versionsDir), "node-versions"), filepath.Join("installation", "bin"))
+
+	case NodeManagerVolta:
+		root := firstNonEmpty(versionsDir, os.Getenv("VOLTA_HOME"), filepath.Join(home, ".volta"))
+		return scanNodeInstalls(filepath.Join(root, "tools", "image", "node"), "bin")
+
+	case NodeManagerDir:
+		if versionsDir == "" {
+			return nil, fmt.Errorf("the %s node manager needs DEPLOY_AGENT_NODE_DIR", NodeManagerDir)
+		}
+		return scanNodeInstalls(versionsDir, "bin")
+	}
+
+	return nil, fmt.Errorf("unknown node manager %q (expected %s, %s, %s or %s)", manager,
+		NodeManagerNVM, NodeManagerFNM, NodeManagerVolta, NodeManagerDir)
+}
+
+func nvmDir(versionsDir string) string {
+	home, _ := os.UserHomeDir()
+	return firstNonEmpty(versionsDir, os.Getenv("NVM_DIR"), filepath.Join(home, ".nvm"))
+}
+
+func fnmDir(versionsDir string) string {
+	if root := firstNonEmpty(versionsDir, os.Getenv("FNM_DIR")); root != "" {
+		return root
+	}
+
+	// fnm moved its default directory, older installs keep ~/.fnm
+	home, _ := os.UserHomeDir()
+	root := filepath.Join(home, ".local", "share", "fnm")
+	if _, err := os.Stat(root); err != nil {
+		root = filepath.Join(home, ".fnm")
+	}
+	return root
+}
+
+// ltsReleases maps each LTS release to its lowercase codename, such as 20.11.1 to iron
+type ltsReleases map[version]string
+
+// newest is the codename of the latest LTS line, what lts/* stands for
+func (r ltsReleases) newest() string {
+	var latest version
+	codename := ""
+	for v, name := range r {
+		if compareVersions(v, latest) > 0 {
+			latest, codename = v, name
+		}
+	}
+	return codename
+}
+
+func (r ltsReleases) has(codename string) bool {
+	for _, name := range r {
+		if name == codename {
+			return true
+		}
+	}
+	return false
+}
+
+// a release line of 'nvm ls-remote --lts' such as "v20.11.1   (Latest LTS: Iron)" or of
+// 'fnm ls-remote --lts' such as "v20.11.1 (Iron)"
+var ltsLine = regexp.MustCompile(`v(\d+\.\d+\.\d+)\s+\((?:Latest )?(?:LTS: )?([A-Za-z]+)\)`)
+
+// listLTS asks the version manager which releases are LTS, only nvm and fnm know
+func listLTS(manager, versionsDir string) (ltsReleases, error) {
+	var cmd *exec.Cmd
+	switch manager {
+	case NodeManagerNVM:
+		// nvm is a shell function, its script has to be sourced first
+		root := nvmDir(versionsDir)
+		cmd = exec.Command("bash", "-c", `. "$NVM_DIR/nvm.sh" && nvm ls-remote --lts --no-colors`)
+		cmd.Env = append(os.Environ(), "NVM_DIR="+root)
+	case NodeManagerFNM:
+		cmd = exec.Command("fnm", "ls-remote", "--lts")
+		cmd.Env = append(os.Environ(), "FNM_DIR="+fnmDir(versionsDir))
+	default:
+		return nil, fmt.Errorf("LTS aliases need the release list of %s or %s, %s has none, ask for a version such as 22 instead",
+			NodeManagerNVM, NodeManagerFNM, managerName(manager))
+	}
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list LTS releases with %s: %w", manager, err)
+	}
+
+	releases := parseLTSList(string(output))
+	if len(releases) == 0 {
+		return nil, fmt.Errorf("%s listed no LTS releases", manager)
+	}
+	return releases, nil
+}
+
+func parseLTSList(output string) ltsReleases {
+	releases := ltsReleases{}
+	for _, match := range ltsLine.FindAllStringSubmatch(output, -1) {
+		if v, ok := parseFullVersion(match[1]); ok {
+			releases[v] = strings.ToLower(match[2])
+		}
+	}
+	return releases
+}
+
+// the Node installs in the subdirectories of root named after their version, such as v18.19.0
+// or node-v18.19.0-linux-x64, with node in the bin subdirectory
+func scanNodeInstalls(root, bin string) (map[string]string, error) {
+	installs := map[string]string{}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return installs, nil
+		}
+		return nil, fmt.Errorf("failed to list node installs in %s: %w", root, err)
+	}
+
+	for _, entry := range entries {
+		version := strings.TrimPrefix(strings.TrimPrefix(entry.Name(), "node-"), "v")
+		version, _, _ = strings.Cut(version, "-")
+		if _, ok := parseFullVersion(version); !ok {
+			continue
+		}
+
+		binDir := filepath.Join(root, entry.Name(), bin)
+		if _, err := os.Stat(filepath.Join(binDir, "node")); err == nil {
+			installs[version] = binDir
+		}
+	}
+
+	return installs, nil
+}
+
+// how to install a missing version with the manager
+func installHint(manager, spec string) string {
+	if manager == NodeManagerNone {
+		return ", set DEPLOY_AGENT_NODE_MANAGER to build with other versions"
+	}
+
+	// Only a plain version can be handed to the manager as it is
+	version := strings.TrimLeft(spec, "^~=")
+	if _, parts, err := parsePartial(version); err != nil || parts == 0 {
+		return fmt.Sprintf(", install a matching version with %s", manager)
+	}
+
+	switch manager {
+	case NodeManagerNVM:
+		return fmt.Sprintf(", run 'nvm install %s'", version)
+	case NodeManagerFNM:
+		return fmt.Sprintf(", run 'fnm install %s'", version)
+	case NodeManagerVolta:
+		return fmt.Sprintf(", run 'volta fetch node@%s'", version)
+	}
+	return fmt.Sprintf(", install node %s in DEPLOY_AGENT_NODE_DIR", version)
+}
+
+func managerName(manager string) string {
+	if manager == NodeManagerNone {
+		return "node on the PATH"
+	}
+	return manager
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Env puts the install's bin directory in front of the PATH, nothing for the node on the PATH
+func (n *Node) Env() []string {
+	if n == nil || n.BinDir == "" {
+		return nil
+	}
+	return []string{"PATH=" + n.BinDir + string(os.PathListSeparator) + os.Getenv("PATH")}
+}
+
+// Interpreter is the node binary PM2 should run the server with, empty for PM2's own
+func (n *Node) Interpreter() string {
+	if n == nil || n.BinDir == "" {
+		return ""
+	}
+	return filepath.Join(n.BinDir, "node")
+}
+
+// lookPath finds a tool in the install's bin directory first, where npm and global packages live
+func (n *Node) lookPath(name string) (string, error) {
+	if n != nil && n.BinDir != "" {
+		path := filepath.Join(n.BinDir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return exec.LookPath(name)
+}
+
+// String names the version and where the requirement came from, for the log
+func (n *Node) String() string {
+	if n.Required == "" {
+		return "node from the PATH"
+	}
+	return fmt.Sprintf("node v%s (%s asks for %s)", n.Version, filepath.Base(n.Source), n.Required)
+}
+
+// version is major, minor and patch
+type version [3]int
+
+func parseVersion(value string) version {
+	v, _ := parseFullVersion(value)
+	return v
+}
+
+// parse a complete version such as 18.19.0
+func parseFullVersion(value string) (version, bool) {
+	var v version
+	parts := strings.Split(strings.TrimPrefix(value, "v"), ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+func compareVersions(a, b version) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// nodeSpecMatcher understands nvm aliases (node, lts/*, lts/<codename>) and npm's semver ranges,
+// the newest installed version it matches is used. LTS aliases match the releases of their line
+// in the list lts loads, only called for them
+func nodeSpecMatcher(spec string, lts func() (ltsReleases, error)) (func(v version) bool, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+
+	switch spec {
+	case "node", "stable", "latest", "current", "*":
+		return func(version) bool { return true }, nil
+	}
+
+	if codename, ok := strings.CutPrefix(spec, "lts/"); ok {
+		releases, err := lts()
+		if err != nil {
+			return nil, err
+		}
+
+		if codename == "*" {
+			codename = releases.newest()
+		} else if !releases.has(codename) {
+			return nil, fmt.Errorf("unknown LTS codename %q", codename)
+		}
+		return func(v version) bool { return releases[v] == codename }, nil
+	}
+
+	ranges, err := parseRange(spec)
+	if err != nil {
+		return nil, err
+	}
+	return ranges.matches, nil
+}
+
+// comparatorSet is a list of bounds that must all hold, a range matches when any set does
+type comparatorSet []func(v version) bool
+
+type versionRange []comparatorSet
+
+func (r versionRange) matches(v version) bool {
+	for _, set := range r {
+		ok := true
+		for _, comparator := range set {
+			if !comparator(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parse an npm semver range such as ">=18 <21", "^20.10.0 || 22.x" or "18.0.0 - 20"
+func parseRange(spec string) (versionRange, error) {
+	var r versionRange
+
+	for _, alternative := range strings.Split(spec, "||") {
+		fields := strings.Fields(alternative)
+		var set comparatorSet
+
+		// A hyphen range: from the first version up to and including the second
+		if len(fields) == 3 && fields[1] == "-" {
+			low, _, err := parsePartial(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			high, highParts, err := parsePartial(fields[2])
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, atLeast(low), upTo(high, highParts))
+			r = append(r, set)
+			continue
+		}
+
+		// Operators may be separated from their version by a space
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			if strings.Trim(field, "<>=~^") == "" && i+1 < len(fields) {
+				field += fields[i+1]
+				i++
+			}
+
+			comparators, err := parseComparator(field)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, comparators...)
+		}
+
+		r = append(r, set)
+	}
+
+	return r, nil
+}
+
+func parseComparator(field string) (comparatorSet, error) {
+	op := ""
+	for _, candidate := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(field, candidate) {
+			op = candidate
+			break
+		}
+	}
+
+	v, parts, err := parsePartial(strings.TrimPrefix(field, op))
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case ">=":
+		return comparatorSet{atLeast(v)}, nil
+	case ">":
+		if parts == 0 {
+			return comparatorSet{func(version) bool { return false }}, nil
+		}
+		return comparatorSet{atLeast(bump(v, parts))}, nil
+	case "<":
+		return comparatorSet{below(v)}, nil
+	case "<=":
+		return comparatorSet{upTo(v, parts)}, nil
+	case "^":
+		// Changes that do not touch the left-most non-zero part are compatible
+		switch {
+		case parts == 0:
+			return comparatorSet{}, nil
+		case v[0] > 0 || parts == 1:
+			return comparatorSet{atLeast(v), below(bump(v, 1))}, nil
+		case v[1] > 0 || parts == 2:
+			return comparatorSet{atLeast(v), below(bump(v, 2))}, nil
+		}
+		return comparatorSet{atLeast(v), below(bump(v, 3))}, nil
+	case "~":
+		if parts == 0 {
+			return comparatorSet{}, nil
+		}
+		if parts == 1 {
+			return comparatorSet{atLeast(v), below(bump(v, 1))}, nil
+		}
+		return comparatorSet{atLeast(v), below(bump(v, 2))}, nil
+	}
+
+	// A bare version, possibly partial: 18 is 18.x.x
+	if parts == 0 {
+		return comparatorSet{}, nil
+	}
+	return comparatorSet{atLeast(v), upTo(v, parts)}, nil
+}
+
+// parse a possibly partial version such as 18, v18.19 or 18.x, parts counts the numbers given
+func parsePartial(value string) (v version, parts int, err error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "v")
+	if value == "" {
+		return v, 0, nil
+	}
+
+	for i, part := range strings.SplitN(value, ".", 3) {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		// Prerelease and build tags are not used to pick a Node install
+		part, _, _ = strings.Cut(part, "-")
+		part, _, _ = strings.Cut(part, "+")
+
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, 0, fmt.Errorf("invalid node version %q", value)
+		}
+		v[i] = n
+		parts = i + 1
+	}
+
+	return v, parts, nil
+}
+
+// the smallest version above every version that starts with the first parts of v
+func bump(v version, parts int) version {
+	var next version
+	copy(next[:parts], v[:parts])
+	next[parts-1]++
+	return next
+}
+
+func atLeast(low version) func(v version) bool {
+	return func(v version) bool { return compareVersions(v, low) >= 0 }
+}
+
+func below(high version) func(v version) bool {
+	return func(v version) bool { return compareVersions(v, high) < 0 }
+}
+
+// every version up to and including high, where a partial high covers all its versions
+func upTo(high version, parts int) func(v version) bool {
+	if parts == 0 {
+		return func(version) bool { return true }
+	}
+	if parts < 3 {
+		return below(bump(high, parts))
+	}
+	return func(v version) bool { return compareVersions(v, high) <= 0 }
+}
@@ -0,0 +1,142 @@
+package build
+
+import (
+	"errors"
+	"testing"
+)
+
+// LTS releases as nvm and fnm list them, a few per line
+var testLTS = parseLTSList(`
+       v18.19.0   (LTS: Hydrogen)
+       v18.20.4   (Latest LTS: Hydrogen)
+       v20.11.1   (LTS: Iron)
+       v20.18.0   (Latest LTS: Iron)
+v22.11.0 (Jod)
+v22.12.0 (Jod)
+`)
+
+func TestParseLTSList(t *testing.T) {
+	tests := []struct {
+		line     string
+		version  version
+		codename string
+	}{
+		{"       v18.19.0   (LTS: Hydrogen)", version{18, 19, 0}, "hydrogen"},
+		{"->     v20.18.0   (Latest LTS: Iron)", version{20, 18, 0}, "iron"},
+		{"v22.12.0 (Jod)", version{22, 12, 0}, "jod"},
+	}
+
+	for _, tt := range tests {
+		releases := parseLTSList(tt.line)
+		if len(releases) != 1 || releases[tt.version] != tt.codename {
+			t.Errorf("parseLTSList(%q) = %v, want %v as %s", tt.line, releases, tt.version, tt.codename)
+		}
+	}
+
+	if releases := parseLTSList("       v21.7.3\n       v23.0.0\n"); len(releases) != 0 {
+		t.Errorf("releases without a codename parsed as LTS: %v", releases)
+	}
+}
+
+func TestNodeSpecMatcher(t *testing.T) {
+	tests := []struct {
+		spec  string
+		match []version
+		miss  []version
+	}{
+		// Bare and partial versions
+		{"18", []version{{18, 0, 0}, {18, 20, 4}}, []version{{17, 9, 1}, {19, 0, 0}}},
+		{"18.19", []version{{18, 19, 0}, {18, 19, 9}}, []version{{18, 18, 2}, {18, 20, 0}}},
+		{"18.19.0", []version{{18, 19, 0}}, []version{{18, 19, 1}}},
+
+		// v-prefixed input
+		{"v20.11.1", []version{{20, 11, 1}}, []version{{20, 11, 0}}},
+		{"v20", []version{{20, 0, 0}, {20, 18, 0}}, []version{{21, 0, 0}}},
+		{">=v18", []version{{18, 0, 0}, {22, 0, 0}}, []version{{16, 20, 2}}},
+
+		// Caret ranges keep the left-most non-zero part
+		{"^20.10", []version{{20, 10, 0}, {20, 18, 0}}, []version{{20, 9, 9}, {21, 0, 0}}},
+		{"^18.19.0", []version{{18, 19, 0}, {18, 20, 4}}, []version{{18, 18, 9}, {19, 0, 0}}},
+		{"^0.10.2", []version{{0, 10, 2}, {0, 10, 9}}, []version{{0, 10, 1}, {0, 11, 0}}},
+		{"^0.0.3", []version{{0, 0, 3}}, []version{{0, 0, 4}}},
+
+		// Tilde ranges allow patch changes, or minor ones with only a major
+		{"~20.11", []version{{20, 11, 0}, {20, 11, 9}}, []version{{20, 12, 0}}},
+		{"~20.11.1", []version{{20, 11, 1}, {20, 11, 5}}, []version{{20, 11, 0}, {20, 12, 0}}},
+		{"~20", []version{{20, 0, 0}, {20, 18, 0}}, []version{{21, 0, 0}}},
+
+		// x ranges
+		{"20.x", []version{{20, 0, 0}, {20, 18, 0}}, []version{{19, 9, 9}, {21, 0, 0}}},
+		{"20.11.X", []version{{20, 11, 0}, {20, 11, 1}}, []version{{20, 12, 0}}},
+		{"22.*", []version{{22, 12, 0}}, []version{{23, 0, 0}}},
+		{"x", []version{{0, 0, 1}, {23, 1, 0}}, nil},
+		{"^x", []version{{0, 0, 1}, {23, 1, 0}}, nil},
+		{"~", []version{{0, 0, 1}, {23, 1, 0}}, nil},
+
+		// Hyphen ranges include the whole upper partial version
+		{"18.0.0 - 20", []version{{18, 0, 0}, {20, 18, 0}}, []version{{17, 9, 9}, {21, 0, 0}}},
+		{"18 - 20.11.1", []version{{18, 0, 0}, {20, 11, 1}}, []version{{20, 11, 2}}},
+
+		// Alternatives
+		{"^18.19 || >=22", []version{{18, 20, 4}, {22, 0, 0}, {23, 1, 0}}, []version{{20, 11, 1}, {18, 18, 0}}},
+		{"16.x||20.x", []version{{16, 20, 2}, {20, 0, 0}}, []version{{18, 19, 0}}},
+
+		// Bounds that must all hold, with or without a space after the operator
+		{">=18 <21", []version{{18, 0, 0}, {20, 18, 0}}, []version{{17, 9, 9}, {21, 0, 0}}},
+		{">= 18.19 < 20", []version{{18, 19, 0}, {19, 9, 0}}, []version{{18, 18, 0}, {20, 0, 0}}},
+		{">18 <=20.11", []version{{19, 0, 0}, {20, 11, 9}}, []version{{18, 20, 4}, {20, 12, 0}}},
+		{">18.19.0", []version{{18, 19, 1}}, []version{{18, 19, 0}}},
+
+		// Aliases
+		{"node", []version{{0, 12, 0}, {23, 1, 0}}, nil},
+		{"lts/*", []version{{22, 11, 0}, {22, 12, 0}}, []version{{20, 18, 0}, {22, 0, 0}, {24, 0, 0}}},
+		{"lts/iron", []version{{20, 11, 1}, {20, 18, 0}}, []version{{20, 0, 0}, {22, 12, 0}}},
+		{"LTS/Hydrogen", []version{{18, 19, 0}}, []version{{18, 0, 0}, {18, 19, 1}}},
+	}
+
+	for _, tt := range tests {
+		matches, err := nodeSpecMatcher(tt.spec, func() (ltsReleases, error) { return testLTS, nil })
+		if err != nil {
+			t.Errorf("nodeSpecMatcher(%q): %v", tt.spec, err)
+			continue
+		}
+		for _, v := range tt.match {
+			if !matches(v) {
+				t.Errorf("%q does not match %v", tt.spec, v)
+			}
+		}
+		for _, v := range tt.miss {
+			if matches(v) {
+				t.Errorf("%q matches %v", tt.spec, v)
+			}
+		}
+	}
+}
+
+func TestNodeSpecMatcherErrors(t *testing.T) {
+	for _, spec := range []string{
+		"eighteen",
+		"18.a",
+		">=18 <twenty",
+		"~v20.y",
+		"18.-1",
+		"1.2.3.4",
+		"lts/unknown",
+	} {
+		if _, err := nodeSpecMatcher(spec, func() (ltsReleases, error) { return testLTS, nil }); err == nil {
+			t.Errorf("nodeSpecMatcher(%q) accepted a malformed version", spec)
+		}
+	}
+}
+
+func TestNodeSpecMatcherLoadsLTSOnlyForAliases(t *testing.T) {
+	unavailable := errors.New("no LTS list")
+	lts := func() (ltsReleases, error) { return nil, unavailable }
+
+	if _, err := nodeSpecMatcher("lts/*", lts); !errors.Is(err, unavailable) {
+		t.Errorf("lts/* without an LTS list: got %v, want %v", err, unavailable)
+	}
+	if _, err := nodeSpecMatcher(">=18", lts); err != nil {
+		t.Errorf("a range loaded the LTS list: %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PackageManager is the tool that installs a project's dependencies and runs its scripts
+type PackageManager struct {
+	// Name is npm, pnpm, yarn or bun
+	Name string
+	// Berry is set for yarn 2 and later, whose install flags differ from yarn classic
+	Berry bool
+	// LockFile is the lock file the package manager was detected from, empty when there is none
+	LockFile string
+	// Dir is where the install runs: the directory of the lock file, which is the workspace
+	// root when the project is a package of a workspace
+	Dir string
+}
+
+// lock files in order of preference when a directory has more than one
+var lockFiles = []struct {
+	file string
+	name string
+}{
+	{"pnpm-lock.yaml", "pnpm"},
+	{"yarn.lock", "yarn"},
+	{"bun.lock", "bun"},
+	{"bun.lockb", "bun"},
+	{"package-lock.json", "npm"},
+	{"npm-shrinkwrap.json", "npm"},
+}
+
+// DetectPackageManager finds the package manager of a project from the packageManager field of
+// its package.json, or else from the lock file in its directory or the workspace root above it.
+// Projects with neither are installed with npm
+func DetectPackageManager(dir string) (*PackageManager, error) {
+	declared, err := declaredPackageManager(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pm := &PackageManager{Name: "npm", Dir: dir}
+	if declared != "" {
+		pm.Name = declared
+	}
+
+	// A package of a workspace has its lock file at the workspace root, up to the checkout's root
+	for current := dir; ; current = filepath.Dir(current) {
+		if name, lockFile := findLockFile(current, declared); lockFile != "" {
+			pm.Name, pm.LockFile, pm.Dir = name, lockFile, current
+			break
+		}
+
+		if _, err := os.Stat(filepath.Join(current, ".git")); err == nil || filepath.Dir(current) == current {
+			break
+		}
+	}
+
+	if pm.Name == "yarn" {
+		pm.Berry = isYarnBerry(pm.Dir, pm.LockFile)
+	}
+
+	switch pm.Name {
+	case "npm", "pnpm", "yarn", "bun":
+	default:
+		return nil, fmt.Errorf("unsupported package manager %q in package.json (expected npm, pnpm, yarn or bun)", pm.Name)
+	}
+
+	return pm, nil
+}
+
+// the tool named by package.json's packageManager field (such as pnpm@9.1.0), empty when it has none
+func declaredPackageManager(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read package.json: %w", err)
+	}
+
+	var pkg struct {
+		PackageManager string `json:"packageManager"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return "", fmt.Errorf("failed to parse package.json: %w", err)
+	}
+
+	name, _, _ := strings.Cut(pkg.PackageManager, "@")
+	return name, nil
+}
+
+// the lock file of a directory, only that of the declared package manager when one is declared
+func findLockFile(dir, declared string) (name, lockFile string) {
+	for _, candidate := range lockFiles {
+		if declared != "" && candidate.name != declared {
+			continue
+		}
+		path := filepath.Join(dir, candidate.file)
+		if _, err := os.Stat(path); err == nil {
+			return candidate.name, path
+		}
+	}
+	return "", ""
+}
+
+// yarn 2+ writes a .yarnrc.yml and a __metadata block to its lock file, yarn classic neither
+func isYarnBerry(dir, lockFile string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".yarnrc.yml")); err == nil {
+		return true
+	}
+	if lockFile == "" {
+		return false
+	}
+
+	data, err := os.ReadFile(lockFile)
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(data, []byte("\n__metadata:"))
+}
+
+// String names the package manager the way it is logged
+func (p *PackageManager) String() string {
+	switch {
+	case p.Name == "yarn" && p.Berry:
+		return "yarn (berry)"
+	case p.Name == "yarn":
+		return "yarn (classic)"
+	}
+	return p.Name
+}
+
+// CheckInstalled fails when the package manager is neither installed with node nor on the PATH
+func (p *PackageManager) CheckInstalled(node *Node) error {
+	if _, err := node.lookPath(p.Name); err != nil {
+		source := "package.json"
+		if p.LockFile != "" {
+			source = filepath.Base(p.LockFile)
+		}
+
+		hint := ""
+		if p.Name == "pnpm" || p.Name == "yarn" {
+			hint = " (install it, or run 'corepack enable' to use the version package.json declares)"
+		}
+		return fmt.Errorf("%s needs %s, which is not installed%s", source, p, hint)
+	}
+	return nil
+}
+
+// InstallArgs is the install that keeps the lock file as it is, or a plain install without one
+func (p *PackageManager) InstallArgs() []string {
+	if p.LockFile == "" {
+		return []string{p.Name, "install"}
+	}
+
+	switch p.Name {
+	case "pnpm", "bun":
+		return []string{p.Name, "install", "--frozen-lockfile"}
+	case "yarn":
+		if p.Berry {
+			return []string{"yarn", "install", "--immutable"}
+		}
+		return []string{"yarn", "install", "--frozen-lockfile"}
+	}
+	return []string{"npm", "ci", "--prefer-offline", "--no-audit"}
+}
+
+// RunArgs runs a script of package.json
+func (p *PackageManager) RunArgs(script string) []string {
+	return []string{p.Name, "run", script}
+}
@@ -1,6 +1,7 @@
 package build
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -18,6 +19,12 @@ type ServerBuilder struct {
 	serverEntry  string
 	pm2Ecosystem string
 	log          *logger.Logger
+
+	// scriptEnv is set when the server entry runs as its own app rather than from the ecosystem file
+	scriptEnv []string
+
+	// node is the Node install the server is built and run with
+	node *Node
 }
 
 func NewServerBuilder(workDir string, projectType types.ProjectType, appName, serverEntry, pm2Ecosystem string, log *logger.Logger) *ServerBuilder {
@@ -40,7 +47,15 @@ func (s *ServerBuilder) Build() (*types.BuildOutput, error) {
 
 	// For JavaScript projects, no build needed
 	if s.projectType == types.ProjectTypeAPIJS {
-		s.log.Info("JavaScript project - no build step required")
+		if s.builder.pipeline.Build != "" {
+			s.log.Infof("Running build command: %s", s.builder.pipeline.Build)
+			if output, err := s.builder.shell(s.builder.pipeline.Build).CombinedOutput(); err != nil {
+				return nil, fmt.Errorf("build failed: %w\nOutput: %s", err, string(output))
+			}
+		} else {
+			s.log.Info("JavaScript project - no build step required")
+		}
+
 		return &types.BuildOutput{
 			Success:   true,
 			OutputDir: s.builder.workDir,
@@ -91,6 +106,38 @@ func (s *ServerBuilder) Build() (*types.BuildOutput, error) {
 	return nil, fmt.Errorf("unsupported project type: %s", s.projectType)
 }
 
+// SetNode builds the server and runs it in PM2 with a Node install other than the node on the PATH
+func (s *ServerBuilder) SetNode(node *Node) {
+	s.node = node
+	s.builder.SetNode(node)
+}
+
+// SetContext cancels the server's build when ctx is cancelled
+func (s *ServerBuilder) SetContext(ctx context.Context) {
+	s.builder.SetContext(ctx)
+}
+
+// SetInstallCache skips the server's install when its dependencies did not change
+func (s *ServerBuilder) SetInstallCache(cache *InstallCache, clean bool) {
+	s.builder.SetInstallCache(cache, clean)
+}
+
+// Verify runs the server's tests against the build
+func (s *ServerBuilder) Verify() error {
+	return s.builder.Verify()
+}
+
+// SetPipeline builds the server with the pipeline declared in its .deploy.yml
+func (s *ServerBuilder) SetPipeline(pipeline *types.Pipeline) {
+	s.builder.SetPipeline(pipeline)
+}
+
+// RunAsScript makes Deploy start the server entry under the builder's app name with extra
+// environment variables, for copies of an app that must not touch the ecosystem file's apps
+func (s *ServerBuilder) RunAsScript(env []string) {
+	s.scriptEnv = env
+}
+
 // Deploy deploys the server using PM2
 func (s *ServerBuilder) Deploy(workDir string) error {
 	s.log.Info("Deploying server with PM2...")
@@ -100,6 +147,11 @@ func (s *ServerBuilder) Deploy(workDir string) error {
 	}
 
 	pm2Manager := pm2.New(s.appName, workDir, s.log)
+	pm2Manager.SetInterpreter(s.node.Interpreter())
+
+	if s.scriptEnv != nil {
+		return s.deployScript(pm2Manager)
+	}
 
 	// Check if app exists
 	exists, err := pm2Manager.AppExists()
@@ -107,6 +159,17 @@ func (s *ServerBuilder) Deploy(workDir string) error {
 		return fmt.Errorf("failed to check PM2 app: %w", err)
 	}
 
+	// A restart keeps the interpreter the app was started with, a new Node version needs a new app
+	if exists && s.node.Interpreter() != "" {
+		if current, err := pm2Manager.GetInterpreter(); err == nil && current != s.node.Interpreter() {
+			s.log.Infof("Node version changed (%s), recreating PM2 app...", s.node.Interpreter())
+			if err := pm2Manager.Delete(); err != nil {
+				return fmt.Errorf("failed to recreate PM2 app: %w", err)
+			}
+			exists = false
+		}
+	}
+
 	if exists {
 		s.log.Info("Restarting existing PM2 app...")
 		if err := pm2Manager.Restart(s.pm2Ecosystem); err != nil {
@@ -133,4 +196,28 @@ func (s *ServerBuilder) Deploy(workDir string) error {
 
 	s.log.Success("Server deployed successfully with PM2")
 	return nil
-}
\ No newline at end of file
+}
+
+// start the server entry as its own PM2 app and wait for it to come online
+func (s *ServerBuilder) deployScript(pm2Manager *pm2.PM2Manager) error {
+	if err := pm2Manager.StartScript(s.serverEntry, s.scriptEnv); err != nil {
+		return err
+	}
+
+	var status string
+	var err error
+	for attempt := 1; attempt <= 5; attempt++ {
+		time.Sleep(3 * time.Second)
+
+		if status, err = pm2Manager.GetStatus(); err == nil && status == "online" {
+			s.log.Successf("PM2 app '%s' is running", s.appName)
+			pm2Manager.Save()
+			return nil
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("PM2 app not running: %w", err)
+	}
+	return fmt.Errorf("PM2 app status is '%s' after 5 attempts", status)
+}
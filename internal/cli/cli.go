@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+)
+
+// command is a single deploy-agent subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(cfg *config.Config, args []string) int
+}
+
+func commands() []command {
+	return []command{
+		{"deploy", "Deploy a repository (flags or GITHUB_* environment variables)", runDeploy},
+		{"rollback", "Restore the previous deployment of a repository", runRollback},
+		{"status", "Show what is currently deployed for each repository", runStatus},
+		{"history", "List recent deployments", runHistory},
+		{"logs", "Print the log of a deployment", runLogs},
+		{"doctor", "Check that the agent's tools, directories and config are usable", runDoctor},
+		{"serve", "Receive push webhooks and deploy verified pushes", runServe},
+		{"queue", "List or drop pushes waiting to be deployed", runQueue},
+		{"preview", "List, destroy or prune the preview environments of branches", runPreview},
+	}
+}
+
+// Run dispatches to a subcommand and returns the process exit code.
+// With no subcommand it deploys from the environment, which is how the webhook server calls it
+func Run(args []string) int {
+	cfg := config.LoadConfig()
+
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && !isHelpFlag(args[0]) {
+		return runDeploy(cfg, args)
+	}
+
+	if isHelpFlag(args[0]) || args[0] == "help" {
+		usage(os.Stdout)
+		return 0
+	}
+
+	for _, cmd := range commands() {
+		if cmd.name == args[0] {
+			return cmd.run(cfg, args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+	usage(os.Stderr)
+	return 2
+}
+
+func isHelpFlag(arg string) bool {
+	return arg == "-h" || arg == "--help" || arg == "-help"
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: deploy-agent <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'deploy-agent <command> -h' for the flags of a command.")
+	fmt.Fprintln(w, "Without a command, a deployment is run from the GITHUB_* environment variables.")
+}
+
+// create a flag set for a subcommand that reports errors instead of exiting
+func newFlagSet(name, usageLine string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: deploy-agent %s %s\n\n", name, usageLine)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse flags, returning the exit code to use when parsing did not succeed
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0, false
+		}
+		return 2, false
+	}
+	return 0, true
+}
+
+// create the agent's directories, printing the error for the caller to exit on
+func ensureDirectories(cfg *config.Config) bool {
+	if err := cfg.EnsureDirectories(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create directories: %v\n", err)
+		return false
+	}
+	return true
+}
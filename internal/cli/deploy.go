@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/deploy"
+	"github.com/Brayzonn/deploy-agent/internal/lock"
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/internal/provider"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// deploy a repository, flags take precedence over the GITHUB_* environment variables
+func runDeploy(cfg *config.Config, args []string) int {
+	req := config.RequestFromEnv()
+
+	fs := newFlagSet("deploy", "[--repo name --owner owner --branch branch] [--commit sha] [--force] [--clean-install]")
+	fs.StringVar(&req.RepoName, "repo", req.RepoName, "repository name (GITHUB_REPO_NAME)")
+	fs.StringVar(&req.RepoOwner, "owner", req.RepoOwner, "repository owner (GITHUB_REPO_OWNER)")
+	fs.StringVar(&req.RepoFullName, "full-name", req.RepoFullName, "owner/repo, defaults to owner/repo from --owner and --repo (GITHUB_REPO_FULL_NAME)")
+	fs.StringVar(&req.Branch, "branch", req.Branch, "branch to deploy (GITHUB_BRANCH)")
+	fs.StringVar(&req.Commit, "commit", req.Commit, "commit to deploy, defaults to the branch tip (GITHUB_COMMIT)")
+	fs.StringVar(&req.Provider, "provider", req.Provider, "git host that sent the push: "+strings.Join(provider.Names(), ", "))
+	fs.StringVar(&req.Pusher, "pusher", req.Pusher, "who requested the deployment (GITHUB_PUSHER), defaults to $USER")
+	fs.BoolVar(&req.Force, "force", req.Force, "rebuild and redeploy even when the commit is already live (DEPLOY_FORCE)")
+	fs.BoolVar(&req.CleanInstall, "clean-install", req.CleanInstall, "remove node_modules and install even when the dependencies did not change (DEPLOY_CLEAN_INSTALL)")
+	lockPolicy := fs.String("lock-policy", "", "wait, fail or supersede when another deployment of the repo is running (DEPLOY_LOCK_POLICY)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if req.Pusher == "" {
+		req.Pusher = os.Getenv("USER")
+	}
+
+	if !ensureDirectories(cfg) {
+		return 1
+	}
+
+	// Without flags this is a webhook run, which must set every GITHUB_* variable
+	var ctx *types.DeploymentContext
+	var err error
+	if fs.NFlag() == 0 {
+		ctx, err = config.ValidateEnvironment(cfg)
+	} else {
+		ctx, err = config.NewDeploymentContext(cfg, req)
+	}
+	if errors.Is(err, config.ErrBranchNotMapped) {
+		fmt.Printf("Ignoring push: %v\n", err)
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Environment validation failed: %v\n", err)
+		return 1
+	}
+
+	if *lockPolicy != "" {
+		if _, err := lock.ParsePolicy(*lockPolicy); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 2
+		}
+		ctx.LockPolicy = *lockPolicy
+	}
+
+	return executeDeployment(cfg, ctx)
+}
+
+// run a deployment with its own log file and print the outcome
+func executeDeployment(cfg *config.Config, ctx *types.DeploymentContext) int {
+	log, err := logger.New(ctx.DeploymentID, cfg.VerboseLogDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create logger: %v\n", err)
+		return 1
+	}
+	defer log.Close()
+
+	log.Infof("=== Deploying %s ===", ctx.RepoName)
+	log.Infof("Deployment ID: %s", ctx.DeploymentID)
+	log.Infof("Repository: %s", ctx.RepoFullName)
+	log.Infof("Branch: %s", ctx.Branch)
+	log.Infof("Commit: %s", ctx.ShortCommit())
+	log.Infof("Pushed by: %s", ctx.Pusher)
+	if ctx.Force {
+		log.Info("Force: yes")
+	}
+	if ctx.CleanInstall {
+		log.Info("Clean install: yes")
+	}
+	log.Info("==================================")
+
+	executor := deploy.New(ctx, cfg, log)
+
+	if err := executor.Execute(); err != nil {
+		if errors.Is(err, lock.ErrSuperseded) {
+			log.Warning("Deployment superseded by a newer push")
+			return 0
+		}
+		log.Errorf("Deployment failed: %v", err)
+		return 1
+	}
+
+	log.Success("Deployment completed successfully!")
+	return 0
+}
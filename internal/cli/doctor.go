@@ -0,0 +1,218 @@
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/Brayzonn/deploy-agent/internal/build"
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/git"
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// doctor collects the outcome of each check
+type doctor struct {
+	log    *logger.Logger
+	failed int
+}
+
+func (d *doctor) pass(format string, args ...interface{}) {
+	d.log.Successf(format, args...)
+}
+
+func (d *doctor) warn(format string, args ...interface{}) {
+	d.log.Warningf(format, args...)
+}
+
+func (d *doctor) fail(format string, args ...interface{}) {
+	d.log.Errorf(format, args...)
+	d.failed++
+}
+
+// check that the tools, directories and config the agent depends on are usable
+func runDoctor(cfg *config.Config, args []string) int {
+	fs := newFlagSet("doctor", "")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	d := &doctor{log: logger.DefaultLogger()}
+
+	repoConfigs := d.checkConfig(cfg)
+	d.checkDirectories(cfg)
+	d.checkTools(repoConfigs)
+	d.checkRepos(cfg, repoConfigs)
+
+	if d.failed > 0 {
+		d.log.Errorf("%d check(s) failed", d.failed)
+		return 1
+	}
+
+	d.log.Success("All checks passed")
+	return 0
+}
+
+func (d *doctor) checkConfig(cfg *config.Config) map[string]*types.RepoConfig {
+	repoConfigs, err := cfg.LoadRepoConfigs()
+	if err != nil {
+		d.fail("Repository config: %v", err)
+		return nil
+	}
+
+	if len(repoConfigs) == 0 {
+		d.warn("Repository config: no repositories declared in %s or %s", cfg.ReposFile, cfg.ReposConfDir)
+	} else {
+		d.pass("Repository config: %d repositories declared", len(repoConfigs))
+	}
+
+	if cfg.Strict {
+		d.pass("Strict mode: on, unknown repositories are refused")
+	} else {
+		d.warn("Strict mode: off, unknown repositories fall back to a generic client config")
+	}
+
+	if len(cfg.AllowedRepos) == 0 {
+		d.warn("Allowlist: DEPLOY_AGENT_ALLOWED_REPOS is empty, any owner is accepted")
+	} else {
+		d.pass("Allowlist: %v", cfg.AllowedRepos)
+	}
+
+	return repoConfigs
+}
+
+func (d *doctor) checkDirectories(cfg *config.Config) {
+	if err := cfg.EnsureDirectories(); err != nil {
+		d.fail("Directories: %v", err)
+		return
+	}
+
+	for _, dir := range []string{cfg.LogDir, cfg.StateDir, cfg.BackupDir, cfg.VerboseLogDir} {
+		probe, err := os.CreateTemp(dir, ".doctor-*")
+		if err != nil {
+			d.fail("Directory %s is not writable: %v", dir, err)
+			continue
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+		d.pass("Directory %s is writable", dir)
+	}
+}
+
+func (d *doctor) checkTools(repoConfigs map[string]*types.RepoConfig) {
+	needsPM2, needsDocker := false, false
+	for _, repoConfig := range repoConfigs {
+		if repoConfig.UseDocker || repoConfig.ProjectType == types.ProjectTypeDocker {
+			needsDocker = true
+		} else if repoConfig.ProjectType == types.ProjectTypeAPIJS || repoConfig.ProjectType == types.ProjectTypeAPITS {
+			needsPM2 = true
+		}
+	}
+
+	tools := []struct {
+		name     string
+		required bool
+	}{
+		{"git", true},
+		{"node", true},
+		{"npm", true},
+		{"pm2", needsPM2},
+		{"docker-compose", needsDocker},
+		{"nginx", false},
+		{"certbot", false},
+		{"sudo", true},
+	}
+
+	for _, tool := range tools {
+		path, err := exec.LookPath(tool.name)
+		switch {
+		case err == nil:
+			d.pass("%s: %s", tool.name, path)
+		case tool.required:
+			d.fail("%s: not found in PATH", tool.name)
+		default:
+			d.warn("%s: not found in PATH", tool.name)
+		}
+	}
+
+	// nginx and certbot run through sudo and must not prompt for a password
+	cmd := exec.Command("sudo", "-n", "nginx", "-t")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		d.fail("sudo -n nginx -t failed: %v\n%s", err, string(output))
+	} else {
+		d.pass("sudo nginx -t works without a password")
+	}
+}
+
+func (d *doctor) checkRepos(cfg *config.Config, repoConfigs map[string]*types.RepoConfig) {
+	for name := range repoConfigs {
+		repoConfig, err := cfg.GetRepoConfig(name, os.Getenv("USER"))
+		if err != nil {
+			d.fail("%s: %v", name, err)
+			continue
+		}
+
+		gitManager := git.New(repoConfig.RepoDir, "", d.log)
+		if err := gitManager.Validate(); err != nil {
+			d.warn("%s: %v (it will be cloned on the first deployment)", name, err)
+			continue
+		}
+
+		if repoConfig.WebRoot != "" && repoConfig.ProjectType == types.ProjectTypeClient {
+			if _, err := os.Stat(filepath.Dir(repoConfig.WebRoot)); err != nil {
+				d.warn("%s: web root parent %s does not exist", name, filepath.Dir(repoConfig.WebRoot))
+				continue
+			}
+		}
+
+		d.checkBuildTools(cfg, name, repoConfig)
+		d.pass("%s: %s", name, repoConfig.RepoDir)
+	}
+}
+
+// the Node version and package manager each built directory of a checkout asks for must be installed
+func (d *doctor) checkBuildTools(cfg *config.Config, name string, repoConfig *types.RepoConfig) {
+	if repoConfig.UseDocker || repoConfig.ProjectType == types.ProjectTypeDocker {
+		return
+	}
+
+	dirs := []string{repoConfig.ServerDir}
+	if repoConfig.FullStack || repoConfig.ProjectType == types.ProjectTypeClient {
+		dirs = []string{repoConfig.ClientDir, repoConfig.ServerDir}
+	}
+	if len(repoConfig.Components) > 0 {
+		dirs = nil
+		for _, component := range repoConfig.Components {
+			dirs = append(dirs, component.Dir)
+		}
+	}
+
+	checked := map[string]bool{}
+	for _, dir := range dirs {
+		workDir := filepath.Join(repoConfig.RepoDir, dir)
+		if checked[workDir] {
+			continue
+		}
+		checked[workDir] = true
+
+		if _, err := os.Stat(filepath.Join(workDir, "package.json")); err != nil {
+			continue
+		}
+
+		node, err := build.ResolveNode(workDir, cfg.NodeManager, cfg.NodeDir)
+		if err != nil {
+			d.fail("%s: %v", name, err)
+			continue
+		}
+
+		pm, err := build.DetectPackageManager(workDir)
+		if err != nil {
+			d.fail("%s: %v", name, err)
+			continue
+		}
+		if err := pm.CheckInstalled(node); err != nil {
+			d.fail("%s: %v", name, err)
+		}
+	}
+}
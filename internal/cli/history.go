@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/state"
+)
+
+// list recent deployments from their records, newest first
+func runHistory(cfg *config.Config, args []string) int {
+	fs := newFlagSet("history", "[--repo name] [-n count] [deployment-id]")
+	repo := fs.String("repo", "", "only show deployments of this repository")
+	limit := fs.Int("n", 20, "number of deployments to show")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	store := state.NewStore(cfg.StateDir)
+
+	if deploymentID := fs.Arg(0); deploymentID != "" {
+		record, err := store.Find(deploymentID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		printRecord(record)
+		return 0
+	}
+
+	records, err := store.List(*repo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read deployment records: %v\n", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEPLOYMENT\tSTARTED\tREPO\tBRANCH\tREQUESTED\tDEPLOYED\tBY\tDURATION\tRESULT")
+
+	for i, record := range records {
+		if *limit > 0 && i >= *limit {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			record.DeploymentID,
+			record.StartedAt.Format("2006-01-02 15:04:05"),
+			recordTarget(record),
+			record.Branch,
+			shortSHA(record.RequestedCommit),
+			shortSHA(record.DeployedCommit),
+			record.Pusher,
+			recordDuration(record),
+			record.Result)
+	}
+
+	w.Flush()
+	return 0
+}
+
+// print every detail of a single deployment
+func printRecord(record *state.Record) {
+	fmt.Printf("Deployment:  %s\n", record.DeploymentID)
+	fmt.Printf("Repository:  %s\n", record.RepoFullName)
+	if record.Environment != "" {
+		fmt.Printf("Environment: %s\n", record.Environment)
+	}
+	fmt.Printf("Branch:      %s\n", record.Branch)
+	fmt.Printf("Requested:   %s\n", record.RequestedCommit)
+	fmt.Printf("Deployed:    %s\n", record.DeployedCommit)
+	fmt.Printf("Pushed by:   %s\n", record.Pusher)
+	if record.Forced {
+		fmt.Println("Forced:      yes")
+	}
+	fmt.Printf("Started:     %s\n", record.StartedAt.Format(time.RFC3339))
+	if record.FinishedAt != nil {
+		fmt.Printf("Finished:    %s (%s)\n", record.FinishedAt.Format(time.RFC3339), recordDuration(record))
+	}
+	fmt.Printf("Result:      %s\n", record.Result)
+	if record.Error != "" {
+		fmt.Printf("Error:       %s\n", record.Error)
+	}
+	if record.RolledBackTo != "" {
+		fmt.Printf("Rolled back: %s\n", record.RolledBackTo)
+	}
+	if record.LogFile != "" {
+		fmt.Printf("Log:         %s\n", record.LogFile)
+	}
+
+	if len(record.Components) > 0 {
+		fmt.Println("Components:")
+		for _, component := range record.Components {
+			if component.Error != "" {
+				fmt.Printf("  %-20s %s: %s\n", component.Name, component.Result, component.Error)
+			} else {
+				fmt.Printf("  %-20s %s\n", component.Name, component.Result)
+			}
+		}
+	}
+
+	fmt.Println("States:")
+	for _, transition := range record.Transitions {
+		fmt.Printf("  %s  %s\n", transition.At.Format("15:04:05"), transition.State)
+	}
+}
+
+// the repository, or repository.environment, a record deployed
+func recordTarget(record *state.Record) string {
+	if record.Environment == "" {
+		return record.Repo
+	}
+	return record.Repo + "." + record.Environment
+}
+
+func recordDuration(record *state.Record) string {
+	if record.FinishedAt == nil {
+		return "-"
+	}
+	return record.FinishedAt.Sub(record.StartedAt).Round(time.Second).String()
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	if sha == "" {
+		return "-"
+	}
+	return sha
+}
@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/internal/state"
+)
+
+// print the log of a deployment, the latest one by default
+func runLogs(cfg *config.Config, args []string) int {
+	fs := newFlagSet("logs", "[--repo name] [-f] [deployment-id]")
+	repo := fs.String("repo", "", "show the latest deployment of this repository")
+	follow := fs.Bool("f", false, "keep printing new lines as they are written")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	path, err := findDeploymentLog(cfg, fs.Arg(0), *repo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open log: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(os.Stdout, file); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read log: %v\n", err)
+		return 1
+	}
+
+	if !*follow {
+		return 0
+	}
+
+	for {
+		time.Sleep(time.Second)
+		if _, err := io.Copy(os.Stdout, file); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read log: %v\n", err)
+			return 1
+		}
+	}
+}
+
+// resolve a deployment ID, or the latest deployment (of a repository), to its log file
+func findDeploymentLog(cfg *config.Config, deploymentID, repo string) (string, error) {
+	if deploymentID != "" {
+		path := logger.LogFilePath(cfg.VerboseLogDir, deploymentID)
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("no log for deployment %s: %w", deploymentID, err)
+		}
+		return path, nil
+	}
+
+	if repo != "" {
+		records, err := state.NewStore(cfg.StateDir).List(repo)
+		if err != nil {
+			return "", fmt.Errorf("failed to read deployment records: %w", err)
+		}
+		if len(records) == 0 || records[0].LogFile == "" {
+			return "", fmt.Errorf("no deployments found for %s", repo)
+		}
+		return records[0].LogFile, nil
+	}
+
+	// Deployment IDs start with a timestamp, so the last name is the newest log
+	matches, err := filepath.Glob(filepath.Join(cfg.VerboseLogDir, "deployment_*.log"))
+	if err != nil || len(matches) == 0 {
+		return "", fmt.Errorf("no deployments found in %s", cfg.VerboseLogDir)
+	}
+	sort.Strings(matches)
+	return matches[len(matches)-1], nil
+}
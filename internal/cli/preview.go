@@ -0,0 +1,171 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/internal/preview"
+)
+
+// list, destroy or prune the preview environments of feature branches
+func runPreview(cfg *config.Config, args []string) int {
+	if len(args) == 0 || isHelpFlag(args[0]) {
+		previewUsage(os.Stderr)
+		if len(args) > 0 {
+			return 0
+		}
+		return 2
+	}
+
+	switch args[0] {
+	case "list":
+		return runPreviewList(cfg, args[1:])
+	case "destroy":
+		return runPreviewDestroy(cfg, args[1:])
+	case "prune":
+		return runPreviewPrune(cfg, args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown preview action: %s\n\n", args[0])
+	previewUsage(os.Stderr)
+	return 2
+}
+
+func previewUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: deploy-agent preview <action> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Actions:")
+	fmt.Fprintln(w, "  list       List the previews and when they expire")
+	fmt.Fprintln(w, "  destroy    Tear down the preview of a branch")
+	fmt.Fprintln(w, "  prune      Tear down every preview whose TTL ran out")
+}
+
+func runPreviewList(cfg *config.Config, args []string) int {
+	fs := newFlagSet("preview list", "[--repo name]")
+	repo := fs.String("repo", "", "only list the previews of this repository")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	records, err := preview.NewStore(cfg.StateDir).List(*repo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list previews: %v\n", err)
+		return 1
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No previews")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tBRANCH\tURL\tPORT\tDEPLOYED\tEXPIRES")
+
+	for _, record := range records {
+		port, deployed := "-", "never"
+		if record.Port > 0 {
+			port = fmt.Sprintf("%d", record.Port)
+		}
+		if record.DeployedAt != nil {
+			deployed = record.DeployedAt.Format("2006-01-02 15:04:05")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\thttps://%s\t%s\t%s\t%s\n",
+			record.Repo,
+			record.Branch,
+			record.Domains[0],
+			port,
+			deployed,
+			record.ExpiresAt.Format("2006-01-02 15:04:05"))
+	}
+
+	w.Flush()
+	return 0
+}
+
+func runPreviewDestroy(cfg *config.Config, args []string) int {
+	fs := newFlagSet("preview destroy", "--repo name --branch branch")
+	repo := fs.String("repo", "", "repository name")
+	branch := fs.String("branch", "", "branch whose preview is torn down")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *repo == "" || *branch == "" {
+		fmt.Fprintln(os.Stderr, "--repo and --branch are required")
+		return 2
+	}
+
+	store := preview.NewStore(cfg.StateDir)
+
+	// The record knows everything the preview created, the repo config may have changed since
+	record, err := store.Get(*repo, config.BranchSlug(*branch))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read preview: %v\n", err)
+		return 1
+	}
+	if record == nil {
+		fmt.Printf("%s@%s has no preview\n", *repo, *branch)
+		return 0
+	}
+
+	return destroyPreviews(cfg, store, []*preview.Record{record}, false)
+}
+
+func runPreviewPrune(cfg *config.Config, args []string) int {
+	fs := newFlagSet("preview prune", "")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	store := preview.NewStore(cfg.StateDir)
+
+	expired, err := store.Expired(time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list previews: %v\n", err)
+		return 1
+	}
+	if len(expired) == 0 {
+		return 0
+	}
+
+	return destroyPreviews(cfg, store, expired, true)
+}
+
+// destroy previews with a log of their own, carrying on past a failed one. Expired previews are
+// kept when a deployment gave them a new expiry before they could be destroyed
+func destroyPreviews(cfg *config.Config, store *preview.Store, records []*preview.Record, expired bool) int {
+	if !ensureDirectories(cfg) {
+		return 1
+	}
+
+	logID := fmt.Sprintf("preview_%s_%d", time.Now().Format("20060102_150405"), os.Getpid())
+	log, err := logger.New(logID, cfg.VerboseLogDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create logger: %v\n", err)
+		return 1
+	}
+	defer log.Close()
+
+	code := 0
+	for _, record := range records {
+		if time.Now().After(record.ExpiresAt) {
+			log.Infof("Preview of %s@%s expired at %s", record.Repo, record.Branch, record.ExpiresAt.Format("2006-01-02 15:04:05"))
+		}
+		destroy := store.Destroy
+		if expired {
+			destroy = store.DestroyExpired
+		}
+		if err := destroy(record, log); err != nil {
+			log.Errorf("%v", err)
+			code = 1
+		}
+	}
+
+	return code
+}
@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/queue"
+)
+
+// list the pushes waiting to be deployed, or drop one of them
+func runQueue(cfg *config.Config, args []string) int {
+	fs := newFlagSet("queue", "[--repo name] [--drop entry-id]")
+	repo := fs.String("repo", "", "only show the queue of this repository")
+	drop := fs.String("drop", "", "remove a pending entry from the queue of --repo")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	q := queue.New(cfg.StateDir)
+
+	if *drop != "" {
+		if *repo == "" {
+			fmt.Fprintln(os.Stderr, "--drop requires --repo")
+			return 2
+		}
+		if err := q.Remove(*repo, *drop); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to drop %s: %v\n", *drop, err)
+			return 1
+		}
+		fmt.Printf("Dropped %s from the queue of %s\n", *drop, *repo)
+		return 0
+	}
+
+	entries, err := q.List(*repo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the queue: %v\n", err)
+		return 1
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("Nothing queued")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTRY\tQUEUED\tREPO\tBRANCH\tCOMMIT\tBY\tPUSHES\tSTATUS")
+
+	for _, entry := range entries {
+		commit := shortSHA(entry.Commit)
+		if entry.Deleted {
+			commit = "deleted"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			entry.ID,
+			entry.QueuedAt.Format("2006-01-02 15:04:05"),
+			entry.Repo,
+			entry.Branch,
+			commit,
+			entry.Pusher,
+			entry.Pushes,
+			entry.Status)
+	}
+
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// repoFlags selects a repository, and one of its environments, for the commands that operate on one
+type repoFlags struct {
+	name  string
+	owner string
+	env   string
+}
+
+func addRepoFlags(fs *flag.FlagSet) *repoFlags {
+	r := &repoFlags{}
+	fs.StringVar(&r.name, "repo", "", "repository name")
+	fs.StringVar(&r.owner, "owner", os.Getenv("GITHUB_REPO_OWNER"), "repository owner, only used for the default repo_dir")
+	fs.StringVar(&r.env, "env", "", "environment of the repository, for repositories with environments")
+	return r
+}
+
+// resolve the selected repository's config with defaults and the selected environment applied
+func (r *repoFlags) config(cfg *config.Config) (*types.RepoConfig, error) {
+	if r.name == "" {
+		return nil, fmt.Errorf("--repo is required")
+	}
+
+	repoConfig, err := cfg.GetRepoConfig(r.name, r.ownerOrUser())
+	if err != nil {
+		return nil, err
+	}
+	return config.ForEnvironment(repoConfig, r.env)
+}
+
+func (r *repoFlags) ownerOrUser() string {
+	if r.owner != "" {
+		return r.owner
+	}
+	return os.Getenv("USER")
+}
+
+// return the selected repository, or every configured repository when none was selected, one config per environment
+func (r *repoFlags) configs(cfg *config.Config) ([]*types.RepoConfig, error) {
+	if r.name != "" && r.env != "" {
+		repoConfig, err := r.config(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return []*types.RepoConfig{repoConfig}, nil
+	}
+
+	if r.name != "" {
+		repoConfig, err := cfg.GetRepoConfig(r.name, r.ownerOrUser())
+		if err != nil {
+			return nil, err
+		}
+		return config.Environments(repoConfig), nil
+	}
+
+	declared, err := cfg.LoadRepoConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(declared))
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	repoConfigs := make([]*types.RepoConfig, 0, len(names))
+	for _, name := range names {
+		repoConfig, err := cfg.GetRepoConfig(name, r.ownerOrUser())
+		if err != nil {
+			return nil, err
+		}
+		repoConfigs = append(repoConfigs, config.Environments(repoConfig)...)
+	}
+
+	return repoConfigs, nil
+}
@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/internal/build"
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/git"
+	"github.com/Brayzonn/deploy-agent/internal/lock"
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/internal/state"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// restore the previous deployment of a repository
+func runRollback(cfg *config.Config, args []string) int {
+	fs := newFlagSet("rollback", "--repo name [--env environment] [--to release|deployment-id|commit]")
+	repo := addRepoFlags(fs)
+	to := fs.String("to", "", "release (static sites), deployment ID or commit (servers) to go back to, defaults to the previous one")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	repoConfig, err := repo.config(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Rollback failed: %v\n", err)
+		return 1
+	}
+
+	if !ensureDirectories(cfg) {
+		return 1
+	}
+
+	// Servers and containers are built from the checkout, so going back means deploying an earlier commit again
+	if repoConfig.ProjectType != types.ProjectTypeClient || repoConfig.FullStack || repoConfig.UseDocker || len(repoConfig.Components) > 0 {
+		return rollbackCommit(cfg, repoConfig, *to)
+	}
+
+	rollbackID := fmt.Sprintf("rollback_%s_%d", time.Now().Format("20060102_150405"), os.Getpid())
+	log, err := logger.New(rollbackID, cfg.VerboseLogDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create logger: %v\n", err)
+		return 1
+	}
+	defer log.Close()
+
+	// Never switch releases underneath a running deployment
+	repoLock := lock.New(cfg.StateDir, repoConfig.Target(), rollbackID)
+	if err := repoLock.Acquire(lock.PolicyFail, 0, nil); err != nil {
+		log.Errorf("Rollback failed: %v", err)
+		return 1
+	}
+	defer repoLock.Release()
+
+	clientBuilder := build.NewClientBuilder(repoConfig.RepoDir, repoConfig.WebRoot, repoConfig.KeepReleases, log)
+
+	releaseID := *to
+	if releaseID == "" {
+		releaseID, err = clientBuilder.Releases().Previous()
+		if err != nil {
+			log.Errorf("Rollback failed: %v", err)
+			return 1
+		}
+		if releaseID == "" {
+			log.Errorf("Rollback failed: no release older than the current one in %s", repoConfig.WebRoot)
+			return 1
+		}
+	}
+
+	log.Infof("=== Rolling back %s ===", repoConfig.Target())
+	log.Infof("Web root: %s", repoConfig.WebRoot)
+	log.Infof("Release: %s", releaseID)
+
+	if err := clientBuilder.Rollback(releaseID); err != nil {
+		log.Errorf("Rollback failed: %v", err)
+		return 1
+	}
+
+	log.Success("Rollback completed successfully!")
+	return 0
+}
+
+// redeploy the commit of an earlier successful deployment
+func rollbackCommit(cfg *config.Config, repoConfig *types.RepoConfig, to string) int {
+	gitManager := git.New(repoConfig.RepoDir, "", logger.DefaultLogger())
+	target, err := rollbackTarget(state.NewStore(cfg.StateDir), gitManager, repoConfig, to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Rollback failed: %v\n", err)
+		return 1
+	}
+
+	owner, _, _ := strings.Cut(target.RepoFullName, "/")
+	ctx, err := config.NewDeploymentContext(cfg, types.DeploymentRequest{
+		RepoName:     repoConfig.Name,
+		RepoOwner:    owner,
+		RepoFullName: target.RepoFullName,
+		Branch:       target.Branch,
+		Commit:       target.DeployedCommit,
+		Pusher:       os.Getenv("USER"),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Rollback failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Rolling %s back to %s (deployment %s)\n", repoConfig.Target(), shortSHA(target.DeployedCommit), target.DeploymentID)
+	return executeDeployment(cfg, ctx)
+}
+
+// find the deployment to go back to: the one named by to, or the newest success whose commit precedes the live one
+func rollbackTarget(store *state.Store, gitManager *git.GitManager, repoConfig *types.RepoConfig, to string) (*state.Record, error) {
+	records, err := store.List(repoConfig.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deployment records: %w", err)
+	}
+
+	var live *state.Record
+	for _, record := range records {
+		if record.Result != state.ResultSuccess || record.DeployedCommit == "" || record.Environment != repoConfig.Environment {
+			continue
+		}
+
+		if to != "" {
+			if record.DeploymentID == to || strings.HasPrefix(record.DeployedCommit, to) {
+				return record, nil
+			}
+			continue
+		}
+
+		if live == nil {
+			live = record
+			continue
+		}
+		// Skip newer commits that were live before an earlier rollback
+		if record.DeployedCommit == live.DeployedCommit {
+			continue
+		}
+		if older, err := gitManager.IsAncestor(record.DeployedCommit, live.DeployedCommit); err == nil && older {
+			return record, nil
+		}
+	}
+
+	if to != "" {
+		return nil, fmt.Errorf("no successful deployment of %s matches %s", repoConfig.Target(), to)
+	}
+	return nil, fmt.Errorf("no earlier successful deployment of %s to roll back to", repoConfig.Target())
+}
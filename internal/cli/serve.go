@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/internal/server"
+)
+
+// receive push webhooks and deploy every verified push
+func runServe(cfg *config.Config, args []string) int {
+	fs := newFlagSet("serve", "[--listen addr]")
+	listen := fs.String("listen", cfg.ListenAddr, "address to listen on (DEPLOY_AGENT_LISTEN)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if !ensureDirectories(cfg) {
+		return 1
+	}
+
+	// Fail at startup rather than on the first push
+	if _, err := cfg.LoadRepoConfigs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load repository config: %v\n", err)
+		return 1
+	}
+
+	srv, err := server.New(cfg, logger.DefaultLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	if err := srv.ListenAndServe(*listen); err != nil {
+		fmt.Fprintf(os.Stderr, "Server failed: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Brayzonn/deploy-agent/internal/build"
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/git"
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/internal/pm2"
+	"github.com/Brayzonn/deploy-agent/internal/release"
+	"github.com/Brayzonn/deploy-agent/internal/state"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// show the checked out commit and service state of each repository
+func runStatus(cfg *config.Config, args []string) int {
+	fs := newFlagSet("status", "[--repo name]")
+	repo := addRepoFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	repoConfigs, err := repo.configs(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load repository config: %v\n", err)
+		return 1
+	}
+
+	if len(repoConfigs) == 0 {
+		fmt.Printf("No repositories configured in %s or %s\n", cfg.ReposFile, cfg.ReposConfDir)
+		return 0
+	}
+
+	log := logger.DefaultLogger()
+	store := state.NewStore(cfg.StateDir)
+	for i, repoConfig := range repoConfigs {
+		if i > 0 {
+			fmt.Println()
+		}
+		printStatus(repoConfig, store, log)
+	}
+
+	return 0
+}
+
+func printStatus(repoConfig *types.RepoConfig, store *state.Store, log *logger.Logger) {
+	if len(repoConfig.Components) > 0 {
+		fmt.Printf("%s (%d components)\n", repoConfig.Target(), len(repoConfig.Components))
+	} else {
+		fmt.Printf("%s (%s)\n", repoConfig.Target(), repoConfig.ProjectType)
+	}
+	fmt.Printf("  Directory: %s\n", repoConfig.RepoDir)
+
+	if live, err := store.LastSuccessful(repoConfig.Name, repoConfig.Environment); err != nil {
+		fmt.Printf("  Live:      unknown (%v)\n", err)
+	} else if live == nil {
+		fmt.Println("  Live:      no successful deployment recorded")
+	} else {
+		fmt.Printf("  Live:      %s on %s since %s by %s (%s)\n", shortSHA(live.DeployedCommit), live.Branch,
+			live.FinishedAt.Format("2006-01-02 15:04:05"), live.Pusher, live.DeploymentID)
+	}
+
+	if records, err := store.List(repoConfig.Name); err == nil {
+		// The newest run of this environment, shown when it did not go live
+		for _, record := range records {
+			if record.Environment != repoConfig.Environment {
+				continue
+			}
+			if record.Result != state.ResultSuccess {
+				fmt.Printf("  Last run:  %s %s (%s)\n", record.Result, shortSHA(record.RequestedCommit), record.DeploymentID)
+			}
+			break
+		}
+	}
+
+	gitManager := git.New(repoConfig.RepoDir, "", log)
+	if err := gitManager.Validate(); err != nil {
+		fmt.Printf("  Checkout:  not cloned (%v)\n", err)
+	} else if head, err := gitManager.DescribeHead(); err != nil {
+		fmt.Printf("  Checkout:  unknown (%v)\n", err)
+	} else {
+		fmt.Printf("  Checkout:  %s\n", head)
+	}
+
+	if len(repoConfig.Components) == 0 {
+		printServices(repoConfig, "  ", log)
+		return
+	}
+
+	components, err := config.Components(repoConfig)
+	if err != nil {
+		fmt.Printf("  Components: unknown (%v)\n", err)
+		return
+	}
+	for _, component := range components {
+		fmt.Printf("  %s (%s)\n", component.Component, component.ProjectType)
+		printServices(component, "    ", log)
+	}
+}
+
+// the domain, release and running service of a repository or a component of one
+func printServices(repoConfig *types.RepoConfig, indent string, log *logger.Logger) {
+	if repoConfig.Domain != "" {
+		fmt.Printf(indent+"Domain:    %s\n", repoConfig.Domain)
+	}
+
+	if repoConfig.FullStack {
+		if server := repoConfig.FullstackServer(); server.Domain != "" {
+			fmt.Printf(indent+"API:       %s\n", server.Domain)
+		} else if repoConfig.APIPath != "" {
+			fmt.Printf(indent+"API:       %s%s\n", repoConfig.Domain, repoConfig.APIPath)
+		}
+	}
+
+	if repoConfig.WebRoot != "" && (repoConfig.ProjectType == types.ProjectTypeClient || repoConfig.FullStack) {
+		fmt.Printf(indent+"Web root:  %s\n", repoConfig.WebRoot)
+
+		releases := release.New(repoConfig.WebRoot, repoConfig.KeepReleases, log)
+		if current, err := releases.Current(); err != nil {
+			fmt.Printf(indent+"Release:   unknown (%v)\n", err)
+		} else if current == "" {
+			fmt.Println(indent + "Release:   none")
+		} else {
+			ids, _ := releases.List()
+			fmt.Printf(indent+"Release:   %s (%d kept)\n", current, len(ids))
+		}
+	}
+
+	switch {
+	case repoConfig.UseDocker:
+		workDir := repoConfig.RepoDir
+		if repoConfig.ServerDir != "" && repoConfig.ServerDir != "." {
+			workDir = filepath.Join(repoConfig.RepoDir, repoConfig.ServerDir)
+		}
+
+		dockerBuilder := build.NewDockerBuilder(workDir, repoConfig.DockerComposeFile, repoConfig.DockerEnvFile, log)
+		output, err := dockerBuilder.Status()
+		if err != nil {
+			fmt.Printf(indent+"Docker:    unknown (%v)\n", err)
+			return
+		}
+		fmt.Println(indent + "Docker:")
+		for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+			fmt.Printf(indent+"  %s\n", line)
+		}
+
+	case repoConfig.ProjectType == types.ProjectTypeAPIJS || repoConfig.ProjectType == types.ProjectTypeAPITS:
+		status, err := pm2.New(repoConfig.PM2AppName, "", log).GetStatus()
+		if err != nil {
+			fmt.Printf(indent+"PM2:       unknown (%v)\n", err)
+			return
+		}
+		fmt.Printf(indent+"PM2:       %s\n", status)
+	}
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// Components returns the config of every component of a monorepo in dependency order. Each is
+// the repository's config with the component laid over it, shaped like a client or server repository
+func Components(config *types.RepoConfig) ([]*types.RepoConfig, error) {
+	order, err := componentOrder(config.Components)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]*types.RepoConfig, 0, len(order))
+	for _, component := range order {
+		configs = append(configs, withComponent(config, component))
+	}
+	return configs, nil
+}
+
+// copy the repository config with the component's values in place of the repository's
+func withComponent(config *types.RepoConfig, component types.Component) *types.RepoConfig {
+	resolved := *config
+	resolved.Components = nil
+	resolved.Component = component.Name
+	resolved.FullStack = false
+	resolved.ProjectType = component.ProjectType
+
+	// The component's directory and paths decide whether it changed, whichever half it is
+	resolved.ClientDir = component.Dir
+	resolved.ServerDir = component.Dir
+	resolved.ClientPaths = component.Paths
+	resolved.ServerPaths = component.Paths
+
+	resolved.WebRoot = ""
+	if component.ProjectType == types.ProjectTypeClient {
+		resolved.WebRoot = or(component.WebRoot, fmt.Sprintf("/var/www/html/%s-%s", config.Name, component.Name))
+	}
+	if component.KeepReleases > 0 {
+		resolved.KeepReleases = component.KeepReleases
+	}
+
+	resolved.ServerEntry = component.ServerEntry
+	resolved.PM2Ecosystem = component.PM2Ecosystem
+	resolved.PM2AppName = or(component.PM2AppName, config.Name+"-"+component.Name)
+
+	resolved.Domain = component.Domain
+	resolved.DomainAliases = component.DomainAliases
+	resolved.Port = component.Port
+
+	resolved.HealthCheckURL = component.HealthCheckURL
+	if component.HealthCheckTimeout > 0 {
+		resolved.HealthCheckTimeout = component.HealthCheckTimeout
+	}
+
+	return &resolved
+}
+
+// order components so each comes after the components it depends on, otherwise keeping the order of the file
+func componentOrder(components []types.Component) ([]types.Component, error) {
+	byName := make(map[string]types.Component, len(components))
+	for _, component := range components {
+		byName[component.Name] = component
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int, len(components))
+	order := make([]types.Component, 0, len(components))
+
+	var visit func(component types.Component, chain []string) error
+	visit = func(component types.Component, chain []string) error {
+		chain = append(chain[:len(chain):len(chain)], component.Name)
+
+		switch marks[component.Name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("components depend on each other: %s", strings.Join(chain, " -> "))
+		}
+		marks[component.Name] = visiting
+
+		for _, name := range component.DependsOn {
+			dependency, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("component %q depends on %q, which is not a component", component.Name, name)
+			}
+			if err := visit(dependency, chain); err != nil {
+				return err
+			}
+		}
+
+		marks[component.Name] = visited
+		order = append(order, component)
+		return nil
+	}
+
+	for _, component := range components {
+		if err := visit(component, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// check that components can be deployed on their own and never deploy over each other
+func validateComponents(config *types.RepoConfig) error {
+	switch {
+	case config.FullStack:
+		return fmt.Errorf("components replace full_stack, declare the client and server as components")
+	case config.UseDocker || config.ProjectType == types.ProjectTypeDocker:
+		return fmt.Errorf("components are deployed with PM2 and releases, not Docker")
+	case len(config.Environments) > 0:
+		return fmt.Errorf("components cannot be combined with environments")
+	case config.Previews != nil:
+		return fmt.Errorf("components cannot be combined with previews")
+	}
+
+	names := make(map[string]bool)
+	for _, component := range config.Components {
+		// The name ends up in the PM2 app name and the web root
+		if !environmentName.MatchString(component.Name) {
+			return fmt.Errorf("component name %q must be lowercase letters, digits, '-' or '_'", component.Name)
+		}
+		if names[component.Name] {
+			return fmt.Errorf("component %q is defined twice", component.Name)
+		}
+		names[component.Name] = true
+
+		switch component.ProjectType {
+		case types.ProjectTypeClient, types.ProjectTypeAPIJS, types.ProjectTypeAPITS:
+		default:
+			return fmt.Errorf("component %q: unknown project_type %q (expected %s, %s or %s)", component.Name,
+				component.ProjectType, types.ProjectTypeClient, types.ProjectTypeAPIJS, types.ProjectTypeAPITS)
+		}
+
+		if component.Dir == "" || !filepath.IsLocal(component.Dir) || filepath.Clean(component.Dir) == "." {
+			return fmt.Errorf("component %q: dir must be a directory inside the repository", component.Name)
+		}
+
+		for _, pattern := range component.Paths {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("component %q: invalid path pattern %q", component.Name, pattern)
+			}
+		}
+
+		if component.Port < 0 || component.Port > 65535 {
+			return fmt.Errorf("component %q: port %d is out of range", component.Name, component.Port)
+		}
+		if component.HealthCheckTimeout < 0 {
+			return fmt.Errorf("component %q: health_check_timeout must not be negative", component.Name)
+		}
+		if component.KeepReleases < 0 {
+			return fmt.Errorf("component %q: keep_releases must not be negative", component.Name)
+		}
+		if component.WebRoot == "/" || component.WebRoot == "/home" {
+			return fmt.Errorf("component %q: web_root is set to a dangerous value: '%s'", component.Name, component.WebRoot)
+		}
+	}
+
+	configs, err := Components(config)
+	if err != nil {
+		return err
+	}
+
+	// Two components sharing one of these would overwrite each other
+	type use struct{ field, value string }
+	seen := make(map[use]string)
+	for _, resolved := range configs {
+		uses := []use{{"web_root", resolved.WebRoot}, {"domain", resolved.Domain}}
+		for _, alias := range resolved.DomainAliases {
+			uses = append(uses, use{"domain", alias})
+		}
+		if resolved.ProjectType != types.ProjectTypeClient {
+			uses = append(uses, use{"pm2_app_name", resolved.PM2AppName})
+		}
+		if resolved.Port != 0 {
+			uses = append(uses, use{"port", strconv.Itoa(resolved.Port)})
+		}
+
+		for _, u := range uses {
+			if u.value == "" {
+				continue
+			}
+			if other, exists := seen[u]; exists {
+				return fmt.Errorf("components %q and %q use the same %s %s", other, resolved.Component, u.field, u.value)
+			}
+			seen[u] = resolved.Component
+		}
+	}
+
+	return nil
+}
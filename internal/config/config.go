@@ -1,11 +1,15 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/Brayzonn/deploy-agent/internal/provider"
 	"github.com/Brayzonn/deploy-agent/pkg/types"
 )
 
@@ -16,8 +20,21 @@ type Config struct {
 	VerboseLogDir   string
 	SlackWebhookURL string
 	SSLEmail        string  
+	ReposFile       string
+	ReposConfDir    string
+	Strict          bool
+	AllowedRepos    []string
+	LockPolicy      string
+	LockTimeout     time.Duration
+	ListenAddr      string
+	WebhookSecret   string
+	NodeManager     string
+	NodeDir         string
 }
 
+// ErrRepoNotConfigured is returned in strict mode for repositories without a config entry
+var ErrRepoNotConfigured = errors.New("repository has no explicit config")
+
 func LoadConfig() *Config {
 	homeDir, _ := os.UserHomeDir()
 	
@@ -28,42 +45,169 @@ func LoadConfig() *Config {
 		VerboseLogDir:   filepath.Join(homeDir, "logs", "deployments"),
 		SlackWebhookURL: os.Getenv("SLACK_WEBHOOK_URL"),
 		SSLEmail:        os.Getenv("SSL_EMAIL"),
+		ReposFile:       getEnvOrDefault("DEPLOY_AGENT_REPOS_FILE", "/etc/deploy-agent/repos.yaml"),
+		ReposConfDir:    getEnvOrDefault("DEPLOY_AGENT_CONF_DIR", "/etc/deploy-agent/conf.d"),
+		Strict:          getEnvOrDefault("DEPLOY_AGENT_STRICT", "true") != "false",
+		AllowedRepos:    splitList(os.Getenv("DEPLOY_AGENT_ALLOWED_REPOS")),
+		LockPolicy:      getEnvOrDefault("DEPLOY_LOCK_POLICY", "wait"),
+		LockTimeout:     getDurationOrDefault("DEPLOY_LOCK_TIMEOUT", 30*time.Minute),
+		ListenAddr:      getEnvOrDefault("DEPLOY_AGENT_LISTEN", ":9000"),
+		WebhookSecret:   os.Getenv("DEPLOY_AGENT_WEBHOOK_SECRET"),
+		NodeManager:     os.Getenv("DEPLOY_AGENT_NODE_MANAGER"),
+		NodeDir:         os.Getenv("DEPLOY_AGENT_NODE_DIR"),
+	}
+}
+
+// return the environment variable as a duration, or the fallback when it is unset or invalid
+func getDurationOrDefault(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// split a comma separated list, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// IsRepoAllowed reports whether owner/repo matches the allowlist, an empty allowlist allows everything
+func (c *Config) IsRepoAllowed(repoFullName string) bool {
+	if len(c.AllowedRepos) == 0 {
+		return true
+	}
+
+	name := strings.ToLower(repoFullName)
+	for _, pattern := range c.AllowedRepos {
+		if matched, err := path.Match(strings.ToLower(pattern), name); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// return the environment variable or the fallback when it is unset
+func getEnvOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func ValidateEnvironment(cfg *Config) (*types.DeploymentContext, error) {
+	prefix := envPrefix(envProvider())
+	for _, suffix := range []string{"REPO_NAME", "BRANCH", "REPO_OWNER", "PUSHER", "COMMIT", "REPO_FULL_NAME"} {
+		if os.Getenv(prefix+suffix) == "" {
+			return nil, fmt.Errorf("%s is not set", prefix+suffix)
+		}
 	}
+
+	return NewDeploymentContext(cfg, RequestFromEnv())
 }
 
-func ValidateEnvironment() (*types.DeploymentContext, error) {
-	required := map[string]string{
-		"GITHUB_REPO_NAME":      os.Getenv("GITHUB_REPO_NAME"),
-		"GITHUB_BRANCH":         os.Getenv("GITHUB_BRANCH"),
-		"GITHUB_REPO_OWNER":     os.Getenv("GITHUB_REPO_OWNER"),
-		"GITHUB_PUSHER":         os.Getenv("GITHUB_PUSHER"),
-		"GITHUB_COMMIT":         os.Getenv("GITHUB_COMMIT"),
-		"GITHUB_REPO_FULL_NAME": os.Getenv("GITHUB_REPO_FULL_NAME"),
+// RequestFromEnv reads whatever <PROVIDER>_* variables are set (GITHUB_* unless another provider's are), missing ones are left empty
+func RequestFromEnv() types.DeploymentRequest {
+	providerName := envProvider()
+	prefix := envPrefix(providerName)
+
+	return types.DeploymentRequest{
+		RepoName:     os.Getenv(prefix + "REPO_NAME"),
+		Branch:       os.Getenv(prefix + "BRANCH"),
+		RepoOwner:    os.Getenv(prefix + "REPO_OWNER"),
+		Pusher:       os.Getenv(prefix + "PUSHER"),
+		Commit:       os.Getenv(prefix + "COMMIT"),
+		RepoFullName: os.Getenv(prefix + "REPO_FULL_NAME"),
+		Provider:     providerName,
+		Force:        os.Getenv("DEPLOY_FORCE") == "true",
+		CleanInstall: os.Getenv("DEPLOY_CLEAN_INSTALL") == "true",
 	}
+}
 
-	for key, value := range required {
-		if value == "" {
-			return nil, fmt.Errorf("%s is not set", key)
+// the provider whose <PROVIDER>_REPO_NAME variable is set, empty when none is
+func envProvider() string {
+	for _, name := range provider.Names() {
+		if os.Getenv(envPrefix(name)+"REPO_NAME") != "" {
+			return name
 		}
 	}
+	return ""
+}
+
+func envPrefix(providerName string) string {
+	if providerName == "" {
+		providerName = provider.Default
+	}
+	return strings.ToUpper(providerName) + "_"
+}
+
+// NewDeploymentContext checks a deployment request against the allowlist and resolves its repo config
+func NewDeploymentContext(cfg *Config, req types.DeploymentRequest) (*types.DeploymentContext, error) {
+	if req.RepoName == "" || req.RepoOwner == "" {
+		return nil, fmt.Errorf("repository name and owner are required")
+	}
+
+	if req.Branch == "" {
+		return nil, fmt.Errorf("branch is required")
+	}
+
+	if req.RepoFullName == "" {
+		req.RepoFullName = req.RepoOwner + "/" + req.RepoName
+	}
+
+	if !strings.EqualFold(req.RepoFullName, req.RepoOwner+"/"+req.RepoName) {
+		return nil, fmt.Errorf("repository full name %s does not match %s/%s",
+			req.RepoFullName, req.RepoOwner, req.RepoName)
+	}
+
+	if !cfg.IsRepoAllowed(req.RepoFullName) {
+		return nil, fmt.Errorf("repository %s is not in DEPLOY_AGENT_ALLOWED_REPOS", req.RepoFullName)
+	}
 
 	deploymentID := fmt.Sprintf("%s_%d", time.Now().Format("20060102_150405"), os.Getpid())
 
-	repoConfig, err := GetRepoConfig(required["GITHUB_REPO_NAME"], required["GITHUB_REPO_OWNER"])
+	repoConfig, err := cfg.GetRepoConfig(req.RepoName, req.RepoOwner)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get repo config: %w", err)
 	}
 
+	// Pushes to a branch without an environment, or other than the branch of a repository without
+	// environments, are never deployed over production
+	repoConfig, err = ForBranch(repoConfig, req.Branch)
+	if err != nil {
+		return nil, err
+	}
+
+	// A push from one host must never deploy a same-named repository of another
+	configProvider := repoConfig.Provider
+	if configProvider == "" {
+		configProvider = provider.Default
+	}
+	if req.Provider != "" && req.Provider != configProvider {
+		return nil, fmt.Errorf("repository %s is configured for %s, not %s", req.RepoFullName, configProvider, req.Provider)
+	}
+
 	return &types.DeploymentContext{
-		RepoName:     required["GITHUB_REPO_NAME"],
-		Branch:       required["GITHUB_BRANCH"],
-		RepoOwner:    required["GITHUB_REPO_OWNER"],
-		Pusher:       required["GITHUB_PUSHER"],
-		Commit:       required["GITHUB_COMMIT"],
-		RepoFullName: required["GITHUB_REPO_FULL_NAME"],
+		RepoName:     req.RepoName,
+		Branch:       req.Branch,
+		RepoOwner:    req.RepoOwner,
+		Pusher:       req.Pusher,
+		Commit:       req.Commit,
+		RepoFullName: req.RepoFullName,
 		DeploymentID: deploymentID,
 		StartTime:    time.Now(),
 		Config:       repoConfig,
+		Provider:     configProvider,
+		Force:        req.Force,
+		CleanInstall: req.CleanInstall,
+		Deleted:      req.Deleted,
 	}, nil
 }
 
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// ErrBranchNotMapped is returned for pushes to a branch that none of the repository's environments deploy
+var ErrBranchNotMapped = errors.New("branch is not mapped to an environment")
+
+// environment names end up in lock and image names
+var environmentName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ForBranch returns the config of the environment that deploys branch, the first environment
+// with a matching pattern wins, then previews. Repositories without environments only deploy
+// their branch
+func ForBranch(config *types.RepoConfig, branch string) (*types.RepoConfig, error) {
+	for _, env := range config.Environments {
+		for _, pattern := range env.Branches {
+			if matched, err := path.Match(pattern, branch); err == nil && matched {
+				return withEnvironment(config, env), nil
+			}
+		}
+	}
+
+	if IsPreviewBranch(config, branch) {
+		return ForPreview(config, branch), nil
+	}
+
+	if len(config.Environments) == 0 {
+		if branch == config.Branch {
+			return config, nil
+		}
+		return nil, fmt.Errorf("%w: %s only deploys %s, not %s", ErrBranchNotMapped, config.Name, config.Branch, branch)
+	}
+
+	return nil, fmt.Errorf("%w: no environment of %s deploys %s", ErrBranchNotMapped, config.Name, branch)
+}
+
+// ForEnvironment returns the config of a named environment, for commands that act on an environment rather than a push
+func ForEnvironment(config *types.RepoConfig, name string) (*types.RepoConfig, error) {
+	if name == "" {
+		if len(config.Environments) > 0 {
+			return nil, fmt.Errorf("%s has environments, select one with --env", config.Name)
+		}
+		return config, nil
+	}
+
+	for _, env := range config.Environments {
+		if env.Name == name {
+			return withEnvironment(config, env), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s has no environment %q", config.Name, name)
+}
+
+// Environments returns the config of every environment of a repository, or the repository itself when it has none
+func Environments(config *types.RepoConfig) []*types.RepoConfig {
+	if len(config.Environments) == 0 {
+		return []*types.RepoConfig{config}
+	}
+
+	configs := make([]*types.RepoConfig, 0, len(config.Environments))
+	for _, env := range config.Environments {
+		configs = append(configs, withEnvironment(config, env))
+	}
+	return configs
+}
+
+// copy the repository config with the environment's values laid over it
+func withEnvironment(config *types.RepoConfig, env types.Environment) *types.RepoConfig {
+	resolved := *config
+	resolved.Environment = env.Name
+
+	if env.RepoDir != "" {
+		resolved.RepoDir = env.RepoDir
+	}
+	if env.WebRoot != "" {
+		resolved.WebRoot = env.WebRoot
+	}
+	if env.Domain != "" {
+		resolved.Domain = env.Domain
+		resolved.DomainAliases = env.DomainAliases
+	}
+	if env.Port != 0 {
+		resolved.Port = env.Port
+	}
+	if env.ServerDomain != "" {
+		resolved.ServerDomain = env.ServerDomain
+		resolved.ServerDomainAliases = env.ServerDomainAliases
+	}
+	if env.ServerPort != 0 {
+		resolved.ServerPort = env.ServerPort
+	}
+	if env.PM2AppName != "" {
+		resolved.PM2AppName = env.PM2AppName
+	}
+	if env.DockerComposeFile != "" {
+		resolved.DockerComposeFile = env.DockerComposeFile
+	}
+	if env.DockerEnvFile != "" {
+		resolved.DockerEnvFile = env.DockerEnvFile
+	}
+
+	return &resolved
+}
+
+// check that environments can be told apart and never deploy over each other
+func validateEnvironments(config *types.RepoConfig) error {
+	names := make(map[string]bool)
+	for _, env := range config.Environments {
+		if !environmentName.MatchString(env.Name) {
+			return fmt.Errorf("environment name %q must be lowercase letters, digits, '-' or '_'", env.Name)
+		}
+		if names[env.Name] {
+			return fmt.Errorf("environment %q is defined twice", env.Name)
+		}
+		names[env.Name] = true
+
+		if len(env.Branches) == 0 {
+			return fmt.Errorf("environment %q has no branches", env.Name)
+		}
+		for _, pattern := range env.Branches {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("environment %q: invalid branch pattern %q", env.Name, pattern)
+			}
+		}
+
+		if env.Port < 0 || env.Port > 65535 {
+			return fmt.Errorf("environment %q: port %d is out of range", env.Name, env.Port)
+		}
+		if env.ServerPort < 0 || env.ServerPort > 65535 {
+			return fmt.Errorf("environment %q: server_port %d is out of range", env.Name, env.ServerPort)
+		}
+		if (env.ServerDomain != "" || env.ServerPort != 0) && !config.FullStack {
+			return fmt.Errorf("environment %q: server_domain and server_port are only used with full_stack", env.Name)
+		}
+		if env.ServerDomain != "" && config.APIPath != "" {
+			return fmt.Errorf("environment %q: server_domain cannot be combined with api_path", env.Name)
+		}
+		if env.WebRoot == "/" || env.WebRoot == "/home" {
+			return fmt.Errorf("environment %q: web_root is set to a dangerous value: '%s'", env.Name, env.WebRoot)
+		}
+	}
+
+	// Values an environment leaves empty come from the repository, two environments sharing one would overwrite each other
+	usesServer := config.ProjectType != "" && config.ProjectType != types.ProjectTypeClient || config.FullStack
+	usesWebRoot := config.ProjectType == types.ProjectTypeClient || config.FullStack || config.ProjectType == ""
+	shared := []struct {
+		field    string
+		check    bool
+		optional bool
+		value    func(env types.Environment) string
+	}{
+		{"repo_dir", true, false, func(env types.Environment) string { return or(env.RepoDir, config.RepoDir) }},
+		{"web_root", usesWebRoot, false, func(env types.Environment) string { return or(env.WebRoot, config.WebRoot) }},
+		{"pm2_app_name", usesServer && !config.UseDocker, false, func(env types.Environment) string { return or(env.PM2AppName, config.PM2AppName) }},
+		{"domain", true, true, func(env types.Environment) string { return or(env.Domain, config.Domain) }},
+		{"port", usesServer, true, func(env types.Environment) string {
+			if env.Port != 0 {
+				return strconv.Itoa(env.Port)
+			}
+			if config.Port != 0 {
+				return strconv.Itoa(config.Port)
+			}
+			return ""
+		}},
+		{"server_domain", config.FullStack && config.APIPath == "", true, func(env types.Environment) string {
+			return or(env.ServerDomain, config.ServerDomain)
+		}},
+		{"server_port", config.FullStack, true, func(env types.Environment) string {
+			for _, port := range []int{env.ServerPort, config.ServerPort, env.Port, config.Port} {
+				if port != 0 {
+					return strconv.Itoa(port)
+				}
+			}
+			return ""
+		}},
+	}
+
+	for _, field := range shared {
+		if !field.check {
+			continue
+		}
+		seen := make(map[string]string)
+		for _, env := range config.Environments {
+			value := field.value(env)
+			if value == "" && field.optional {
+				continue
+			}
+			if other, exists := seen[value]; exists {
+				return fmt.Errorf("environments %q and %q deploy to the same %s, give one of them its own", other, env.Name, field.field)
+			}
+			seen[value] = env.Name
+		}
+	}
+
+	return nil
+}
+
+func or(value, fallback string) string {
+	if value != "" {
+		return value
+	}
+	return fallback
+}
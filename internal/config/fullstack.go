@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// api_path ends up in the client's nginx config, only plain path segments are allowed
+var apiPath = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+// check the server settings of a fullstack repository
+func validateFullstack(config *types.RepoConfig) error {
+	usesServerFields := config.ServerDomain != "" || len(config.ServerDomainAliases) > 0 || config.ServerPort != 0 ||
+		config.ServerHealthCheckURL != "" || config.APIPath != ""
+	if !config.FullStack {
+		if usesServerFields {
+			return fmt.Errorf("server_domain, server_port, server_health_check_url and api_path are only used with full_stack")
+		}
+		return nil
+	}
+
+	if config.ServerPort < 0 || config.ServerPort > 65535 {
+		return fmt.Errorf("server_port %d is out of range", config.ServerPort)
+	}
+
+	if len(config.ServerDomainAliases) > 0 && config.ServerDomain == "" {
+		return fmt.Errorf("server_domain_aliases needs server_domain")
+	}
+
+	if config.APIPath != "" {
+		if !apiPath.MatchString(config.APIPath) {
+			return fmt.Errorf("api_path %q must be a path such as /api, without a trailing slash", config.APIPath)
+		}
+		if config.ServerDomain != "" {
+			return fmt.Errorf("api_path serves the server on the client's domain, it cannot be combined with server_domain")
+		}
+		if config.Domain == "" {
+			return fmt.Errorf("api_path needs domain, the server is proxied by the client's site")
+		}
+	}
+
+	if config.ServerDomain != "" && config.ServerDomain == config.Domain {
+		return fmt.Errorf("server_domain %s is the client's domain, use api_path to serve both on one domain", config.ServerDomain)
+	}
+
+	// Environments pick their own domain and ports, each must still say where its server is
+	for _, resolved := range Environments(config) {
+		if err := validateServerSite(resolved); err != nil {
+			if resolved.Environment != "" {
+				return fmt.Errorf("environment %q: %w", resolved.Environment, err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// check that the server of a resolved fullstack config is served somewhere that works
+func validateServerSite(config *types.RepoConfig) error {
+	if config.APIPath != "" && config.FullstackServer().Port == 0 {
+		return fmt.Errorf("api_path needs server_port or port, the client's site proxies the path to it")
+	}
+
+	if config.Domain != "" && config.ServerDomain == "" && config.APIPath == "" {
+		return fmt.Errorf("full_stack with a domain needs server_domain or api_path, "+
+			"set server_domain: api.%s to keep serving the server where it was", config.Domain)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Brayzonn/deploy-agent/internal/hooks"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// PipelineFile is where an application declares its own pipeline, in the directory that is built
+const PipelineFile = ".deploy.yml"
+
+// LoadPipeline reads the pipeline file of a directory of the checkout over the repository's config.
+// found is false when the directory has no pipeline file, the built-in pipeline is used then
+func LoadPipeline(dir string, config *types.RepoConfig) (pipeline *types.Pipeline, found bool, err error) {
+	pipeline = &types.Pipeline{
+		Test: config.Test,
+		HealthCheck: types.PipelineHealthCheck{
+			URL:     config.HealthCheckURL,
+			Timeout: config.HealthCheckTimeout,
+		},
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, PipelineFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pipeline, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to read %s: %w", PipelineFile, err)
+	}
+
+	var declared types.Pipeline
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&declared); err != nil && !errors.Is(err, io.EOF) {
+		return nil, true, fmt.Errorf("invalid %s: %w", PipelineFile, err)
+	}
+
+	if err := validatePipeline(&declared); err != nil {
+		return nil, true, fmt.Errorf("invalid %s: %w", PipelineFile, err)
+	}
+
+	if declared.Test == nil {
+		declared.Test = config.Test
+	}
+
+	// Health check settings the file leaves out stay the repository's
+	healthCheck := pipeline.HealthCheck
+	if declared.HealthCheck.URL != "" && config.Preview == nil {
+		// A preview must not check the URL of the environment its branch will be merged into
+		healthCheck.URL = declared.HealthCheck.URL
+	}
+	if declared.HealthCheck.Timeout > 0 {
+		healthCheck.Timeout = declared.HealthCheck.Timeout
+	}
+	declared.HealthCheck = healthCheck
+
+	return &declared, true, nil
+}
+
+// check a pipeline file for values the agent cannot use
+func validatePipeline(pipeline *types.Pipeline) error {
+	// The output is copied into the web root, it must come from the checkout
+	if pipeline.OutputDir != "" && !filepath.IsLocal(pipeline.OutputDir) {
+		return fmt.Errorf("output_dir %q must be a path inside the directory that is built", pipeline.OutputDir)
+	}
+
+	if pipeline.HealthCheck.Timeout < 0 {
+		return fmt.Errorf("health_check.timeout must not be negative")
+	}
+
+	// The file is read from the checkout, which does not exist yet before the fetch
+	if len(pipeline.Hooks.BeforeFetch) > 0 || len(pipeline.Hooks.AfterPull) > 0 {
+		return fmt.Errorf("before_fetch and after_pull hooks run before %s is read, set them in the agent's repo config", PipelineFile)
+	}
+
+	if err := hooks.Validate(&pipeline.Hooks); err != nil {
+		return err
+	}
+
+	return nil
+}
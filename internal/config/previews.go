@@ -0,0 +1,184 @@
+package config
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+const (
+	defaultPreviewBranch = "feature/*"
+	defaultPreviewTTL    = 7 * 24 * time.Hour
+	defaultPreviewPorts  = 4100
+
+	// keeps <slug>.preview.<domain> well inside the 63 character limit of a DNS label
+	maxSlugLength = 40
+)
+
+// IsPreviewBranch reports whether pushes to branch are deployed as a preview
+func IsPreviewBranch(config *types.RepoConfig, branch string) bool {
+	if config.Previews == nil {
+		return false
+	}
+
+	patterns := config.Previews.Branches
+	if len(patterns) == 0 {
+		patterns = []string{defaultPreviewBranch}
+	}
+
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, branch); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ForPreview returns the config of a branch's preview environment: its own worktree, web root,
+// domain and PM2 app. The port is allocated when the preview is first deployed
+func ForPreview(config *types.RepoConfig, branch string) *types.RepoConfig {
+	previews := config.Previews
+	slug := BranchSlug(branch)
+
+	resolved := *config
+	resolved.Environments = nil
+	resolved.Environment = "preview-" + slug
+	resolved.Preview = &types.Preview{
+		Branch:     branch,
+		Slug:       slug,
+		BaseDir:    config.RepoDir,
+		BaseTarget: checkoutTarget(config, config.RepoDir),
+		Project:    strings.ToLower(config.Name) + "-preview-" + slug,
+		TTL:        defaultPreviewTTL,
+		PortMin:    previews.PortMin,
+		PortMax:    previews.PortMax,
+	}
+
+	if ttl, err := time.ParseDuration(previews.TTL); err == nil {
+		resolved.Preview.TTL = ttl
+	}
+	if resolved.Preview.PortMin == 0 {
+		resolved.Preview.PortMin = defaultPreviewPorts
+	}
+	if resolved.Preview.PortMax == 0 {
+		resolved.Preview.PortMax = resolved.Preview.PortMin + 99
+	}
+
+	dir := previews.Dir
+	if dir == "" {
+		dir = config.RepoDir + "-previews"
+	}
+	resolved.RepoDir = filepath.Join(dir, slug)
+
+	webRoot := previews.WebRoot
+	if webRoot == "" {
+		webRoot = fmt.Sprintf("/var/www/html/%s-previews", config.Name)
+	}
+	resolved.WebRoot = filepath.Join(webRoot, slug)
+
+	domain := previews.Domain
+	if domain == "" {
+		domain = "preview." + config.Domain
+	}
+	resolved.Domain = slug + "." + domain
+	resolved.DomainAliases = nil
+
+	resolved.PM2AppName = config.Name + "-preview-" + slug
+	// Production's health check URL and port would check the wrong server
+	resolved.HealthCheckURL = ""
+	resolved.Port = 0
+	// The server half of a fullstack preview runs on the preview's port. It has no site of its own,
+	// with api_path the preview's domain proxies to it
+	resolved.ServerDomain = ""
+	resolved.ServerDomainAliases = nil
+	resolved.ServerPort = 0
+	resolved.ServerHealthCheckURL = ""
+	// A single release is enough, previews are redeployed rather than rolled back
+	resolved.KeepReleases = 1
+
+	return &resolved
+}
+
+// the deployment target that checks out dir, whose lock keeps others out of the checkout.
+// A checkout no environment deploys is guarded by the repository's name
+func checkoutTarget(config *types.RepoConfig, dir string) string {
+	for _, env := range Environments(config) {
+		if env.RepoDir == dir {
+			return env.Target()
+		}
+	}
+	return config.Name
+}
+
+// BranchSlug turns a branch into a DNS label, feature/Login_Page becomes feature-login-page
+func BranchSlug(branch string) string {
+	var slug strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(branch) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			slug.WriteRune(r)
+			dash = false
+		} else if !dash && slug.Len() > 0 {
+			slug.WriteByte('-')
+			dash = true
+		}
+	}
+
+	result := strings.TrimSuffix(slug.String(), "-")
+	if len(result) > maxSlugLength || result == "" {
+		// Long branches keep a readable prefix and a hash so two of them never share a slug
+		sum := sha1.Sum([]byte(branch))
+		prefix := result
+		if len(prefix) > maxSlugLength-8 {
+			prefix = strings.TrimSuffix(prefix[:maxSlugLength-8], "-")
+		}
+		result = strings.TrimPrefix(prefix+"-"+hex.EncodeToString(sum[:])[:7], "-")
+	}
+	return result
+}
+
+// check a previews block for values that can never deploy
+func validatePreviews(config *types.RepoConfig) error {
+	previews := config.Previews
+
+	if previews.Domain == "" && config.Domain == "" {
+		return fmt.Errorf("previews need a domain, set previews.domain or domain")
+	}
+
+	for _, pattern := range previews.Branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("previews: invalid branch pattern %q", pattern)
+		}
+	}
+
+	if previews.TTL != "" {
+		if ttl, err := time.ParseDuration(previews.TTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("previews: ttl %q is not a positive duration such as 72h", previews.TTL)
+		}
+	}
+
+	if previews.PortMin < 0 || previews.PortMax < 0 || previews.PortMin > 65535 || previews.PortMax > 65535 {
+		return fmt.Errorf("previews: port range is out of range")
+	}
+	if previews.PortMin != 0 && previews.PortMax != 0 && previews.PortMax < previews.PortMin {
+		return fmt.Errorf("previews: port_max is below port_min")
+	}
+
+	// The ecosystem file starts production's app, a preview runs the entry under its own name
+	isServer := config.ProjectType != types.ProjectTypeClient || config.FullStack
+	if isServer && !config.UseDocker && config.ServerEntry == "" {
+		return fmt.Errorf("previews of servers need server_entry")
+	}
+
+	if previews.WebRoot == "/" || previews.WebRoot == "/home" {
+		return fmt.Errorf("previews: web_root is set to a dangerous value: '%s'", previews.WebRoot)
+	}
+
+	return nil
+}
@@ -1,82 +1,316 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/Brayzonn/deploy-agent/internal/hooks"
+	"github.com/Brayzonn/deploy-agent/internal/lock"
+	"github.com/Brayzonn/deploy-agent/internal/provider"
 	"github.com/Brayzonn/deploy-agent/pkg/types"
+	"gopkg.in/yaml.v3"
 )
 
-func GetRepoConfig(repoName, repoOwner string) (*types.RepoConfig, error) {
-	configs := map[string]*types.RepoConfig{
-		"zoneyhub": {
-			Name:        "zoneyhub",
-			RepoDir:     fmt.Sprintf("/home/zoney/%s", "zoneyhub"),
-			WebRoot:     fmt.Sprintf("/var/www/html/%s", "zoneyhub"),
-			ProjectType: types.ProjectTypeClient,
-			FullStack:   false,
-			ClientDir:   "client",
-			ServerDir:   "server",
-			ServerEntry: "app.js",
-		},
-		"my-music-stats": {
-			Name:         "my-music-stats",
-			RepoDir:      fmt.Sprintf("/home/zoney/%s", "my-music-stats"),
-			WebRoot:      "/var/www/html/weeklies",
-			ProjectType:  types.ProjectTypeAPITS,
-			FullStack:    true,
-			ClientDir:    "client",
-			ServerDir:    "server",
-			ServerEntry:  "src/main.js",
-			PM2Ecosystem: "ecosystem.config.js",
-		},
-		"URL-Shortener-App": {
-			Name:        "URL-Shortener-App",
-			RepoDir:     fmt.Sprintf("/home/zoney/%s", "URL-Shortener-App"),
-			WebRoot:     fmt.Sprintf("/var/www/html/%s", "URL-Shortener-App"),
-			ProjectType: types.ProjectTypeAPIJS,
-			FullStack:   false,
-			ClientDir:   "client",
-			ServerDir:   "server",
-			ServerEntry: "app.js",
-		},
-		"notifykit": {
-			Name:               "notifykit",
-			RepoDir:            fmt.Sprintf("/home/zoney/%s", "notifykit"),
-			ProjectType:        types.ProjectTypeDocker,
-			UseDocker:          true,
-			DockerComposeFile:  "docker-compose.prod.yml",
-			DockerEnvFile:      ".env.production",
-			RequiresMigrations: true,
-			MigrationCommand:   "npx prisma migrate deploy",
-			Domain:             "api.notifykit.dev",
-			Port:               5932,
-			HealthCheckURL:     "http://localhost:5932/api/v1/health",
-			HealthCheckTimeout: 30,
-		},
-		"notifykit-web": {
-			Name:        "notifykit-web",
-			RepoDir:     fmt.Sprintf("/home/zoney/%s", "notifykit-web"),
-			WebRoot:     fmt.Sprintf("/var/www/html/%s", "notifykit-web"),
-			ProjectType: types.ProjectTypeClient,
-			FullStack:   false,
-			ClientDir:   "client",
-			Domain:        "notifykit.dev",                    
-    		DomainAliases: []string{"www.notifykit.dev"},  
-		},
-	}
-
-	if config, exists := configs[repoName]; exists {
-		return config, nil
-	}
-
-	return &types.RepoConfig{
+// repoEntry is a repository config together with where it was declared
+type repoEntry struct {
+	config *types.RepoConfig
+	file   string
+	line   int
+}
+
+// GetRepoConfig looks up a repository in the config files and fills in defaults.
+// Unknown repositories fail in strict mode and fall back to a generic client config otherwise
+func (c *Config) GetRepoConfig(repoName, repoOwner string) (*types.RepoConfig, error) {
+	entries, err := c.loadRepoEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	if entry, exists := entries[repoName]; exists {
+		config := *entry.config
+		applyDefaults(&config, repoOwner)
+		return &config, nil
+	}
+
+	if c.Strict {
+		return nil, fmt.Errorf("%w: add %q to %s or set DEPLOY_AGENT_STRICT=false", ErrRepoNotConfigured, repoName, c.ReposFile)
+	}
+
+	config := &types.RepoConfig{
 		Name:        repoName,
-		RepoDir:     fmt.Sprintf("/home/%s/%s", repoOwner, repoName),
-		WebRoot:     fmt.Sprintf("/var/www/html/%s", repoName),
 		ProjectType: types.ProjectTypeClient,
-		FullStack:   false,
 		ClientDir:   "client",
 		ServerDir:   "server",
 		ServerEntry: "app.js",
-	}, nil
-}
\ No newline at end of file
+	}
+	applyDefaults(config, repoOwner)
+	return config, nil
+}
+
+// LoadRepoConfigs returns every repository declared in the config files, without defaults applied
+func (c *Config) LoadRepoConfigs() (map[string]*types.RepoConfig, error) {
+	entries, err := c.loadRepoEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]*types.RepoConfig, len(entries))
+	for name, entry := range entries {
+		configs[name] = entry.config
+	}
+	return configs, nil
+}
+
+// read the main repos file and every file in the conf.d directory
+func (c *Config) loadRepoEntries() (map[string]*repoEntry, error) {
+	files, err := c.repoConfigFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*repoEntry)
+	for _, file := range files {
+		fileEntries, err := loadRepoFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range fileEntries {
+			if existing, exists := entries[entry.config.Name]; exists {
+				return nil, fmt.Errorf("%s:%d: repo %q is already defined at %s:%d",
+					entry.file, entry.line, entry.config.Name, existing.file, existing.line)
+			}
+			entries[entry.config.Name] = entry
+		}
+	}
+
+	return entries, nil
+}
+
+// list the config files to load, main file first then conf.d in name order
+func (c *Config) repoConfigFiles() ([]string, error) {
+	var files []string
+
+	if c.ReposFile != "" {
+		if _, err := os.Stat(c.ReposFile); err == nil {
+			files = append(files, c.ReposFile)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read %s: %w", c.ReposFile, err)
+		}
+	}
+
+	if c.ReposConfDir == "" {
+		return files, nil
+	}
+
+	dirEntries, err := os.ReadDir(c.ReposConfDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", c.ReposConfDir, err)
+	}
+
+	var confFiles []string
+	for _, entry := range dirEntries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+			confFiles = append(confFiles, filepath.Join(c.ReposConfDir, entry.Name()))
+		}
+	}
+	sort.Strings(confFiles)
+
+	return append(files, confFiles...), nil
+}
+
+// parse a single repos file, JSON files are read by the YAML parser as well
+func loadRepoFile(path string) ([]*repoEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	// Decode strictly first so unknown or mistyped fields are reported with their line
+	var typed struct {
+		Repos []types.RepoConfig `yaml:"repos"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&typed); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Decode again as nodes to know the line each entry starts on
+	var nodes struct {
+		Repos []yaml.Node `yaml:"repos"`
+	}
+	if err := yaml.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	entries := make([]*repoEntry, 0, len(typed.Repos))
+	for i := range typed.Repos {
+		entry := &repoEntry{
+			config: &typed.Repos[i],
+			file:   path,
+			line:   nodes.Repos[i].Line,
+		}
+
+		if err := validateRepoConfig(entry.config); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", entry.file, entry.line, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// check an entry for values that can never deploy
+func validateRepoConfig(config *types.RepoConfig) error {
+	if config.Name == "" {
+		return fmt.Errorf("repo entry is missing 'name'")
+	}
+
+	switch config.ProjectType {
+	case "", types.ProjectTypeClient, types.ProjectTypeAPIJS, types.ProjectTypeAPITS, types.ProjectTypeDocker:
+	default:
+		return fmt.Errorf("repo %q: unknown project_type %q (expected %s, %s, %s or %s)", config.Name,
+			config.ProjectType, types.ProjectTypeClient, types.ProjectTypeAPIJS, types.ProjectTypeAPITS, types.ProjectTypeDocker)
+	}
+
+	if config.Port < 0 || config.Port > 65535 {
+		return fmt.Errorf("repo %q: port %d is out of range", config.Name, config.Port)
+	}
+
+	if config.HealthCheckTimeout < 0 {
+		return fmt.Errorf("repo %q: health_check_timeout must not be negative", config.Name)
+	}
+
+	if config.KeepReleases < 0 {
+		return fmt.Errorf("repo %q: keep_releases must not be negative", config.Name)
+	}
+
+	if _, err := lock.ParsePolicy(config.LockPolicy); err != nil {
+		return fmt.Errorf("repo %q: %w", config.Name, err)
+	}
+
+	if _, err := provider.Get(config.Provider); err != nil {
+		return fmt.Errorf("repo %q: %w", config.Name, err)
+	}
+
+	if _, err := provider.CloneURL(config, "owner/"+config.Name); err != nil {
+		return fmt.Errorf("repo %q: %w", config.Name, err)
+	}
+
+	if config.WebRoot == "/" || config.WebRoot == "/home" {
+		return fmt.Errorf("repo %q: web_root is set to a dangerous value: '%s'", config.Name, config.WebRoot)
+	}
+
+	for _, pattern := range append(append([]string{}, config.ClientPaths...), config.ServerPaths...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("repo %q: invalid path pattern %q", config.Name, pattern)
+		}
+	}
+
+	for _, test := range config.Test {
+		if strings.TrimSpace(test) == "" {
+			return fmt.Errorf("repo %q: test has an empty command", config.Name)
+		}
+	}
+
+	if len(config.Test) > 0 && (config.UseDocker || config.ProjectType == types.ProjectTypeDocker) {
+		return fmt.Errorf("repo %q: test is not run for Docker deployments, run the tests in the image build", config.Name)
+	}
+
+	if err := hooks.Validate(&config.Hooks); err != nil {
+		return fmt.Errorf("repo %q: %w", config.Name, err)
+	}
+
+	if err := validateFullstack(config); err != nil {
+		return fmt.Errorf("repo %q: %w", config.Name, err)
+	}
+
+	if config.Branch != "" && len(config.Environments) > 0 {
+		return fmt.Errorf("repo %q: branch is replaced by the branches of its environments", config.Name)
+	}
+
+	if err := validateEnvironments(config); err != nil {
+		return fmt.Errorf("repo %q: %w", config.Name, err)
+	}
+
+	if config.Previews != nil {
+		if err := validatePreviews(config); err != nil {
+			return fmt.Errorf("repo %q: %w", config.Name, err)
+		}
+	}
+
+	if len(config.Components) > 0 {
+		if err := validateComponents(config); err != nil {
+			return fmt.Errorf("repo %q: %w", config.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// fill in values that were left out of the config file
+func applyDefaults(config *types.RepoConfig, repoOwner string) {
+	if config.ProjectType == "" {
+		config.ProjectType = types.ProjectTypeClient
+	}
+
+	if config.Branch == "" && len(config.Environments) == 0 {
+		config.Branch = "main"
+	}
+
+	if config.RepoDir == "" {
+		config.RepoDir = fmt.Sprintf("/home/%s/%s", repoOwner, config.Name)
+	}
+
+	if config.WebRoot == "" && (config.ProjectType == types.ProjectTypeClient || config.FullStack) {
+		config.WebRoot = fmt.Sprintf("/var/www/html/%s", config.Name)
+	}
+
+	if config.PM2AppName == "" {
+		config.PM2AppName = config.Name
+	}
+
+	if config.ProjectType == types.ProjectTypeDocker {
+		config.UseDocker = true
+	}
+
+	if config.UseDocker {
+		if config.DockerComposeFile == "" {
+			config.DockerComposeFile = "docker-compose.prod.yml"
+		}
+		if config.DockerEnvFile == "" {
+			config.DockerEnvFile = ".env.production"
+		}
+	}
+
+	if config.RequiresMigrations && config.MigrationCommand == "" {
+		config.MigrationCommand = "npx prisma migrate deploy"
+	}
+
+	if config.HealthCheckTimeout == 0 {
+		config.HealthCheckTimeout = 30
+	}
+
+	if config.KeepReleases == 0 {
+		config.KeepReleases = 5
+	}
+}
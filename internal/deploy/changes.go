@@ -0,0 +1,65 @@
+package deploy
+
+import (
+	"path"
+	"strings"
+)
+
+// changedFiles lists the files changed since the commit that last went live, ok is false when
+// every component has to be deployed: a forced run, a first deployment, or a previous commit
+// that is no longer in the history
+func (e *Executor) changedFiles() (files []string, since string, ok bool) {
+	if e.ctx.Force {
+		return nil, "", false
+	}
+
+	previous, err := e.store.LastSuccessful(e.ctx.RepoName, e.ctx.Config.Environment)
+	if err != nil {
+		e.log.Warningf("Failed to read the last successful deployment, deploying every component: %v", err)
+		return nil, "", false
+	}
+	if previous == nil || previous.DeployedCommit == "" || previous.DeployedCommit == e.targetCommit {
+		return nil, "", false
+	}
+
+	files, err = e.git.ChangedFiles(previous.DeployedCommit, e.targetCommit)
+	if err != nil {
+		e.log.Warningf("Deploying every component: %v", err)
+		return nil, "", false
+	}
+
+	return files, previous.DeployedCommit, true
+}
+
+// whether a component whose code lives in dir, plus the files matching patterns, has changed
+func componentChanged(dir string, patterns []string, files []string) bool {
+	dir = path.Clean(strings.TrimPrefix(dir, "./"))
+	if dir == "." {
+		return true
+	}
+
+	for _, file := range files {
+		if matchPath(dir, file) {
+			return true
+		}
+		for _, pattern := range patterns {
+			if matchPath(pattern, file) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// a pattern matches a file, or a directory the file is in
+func matchPath(pattern, file string) bool {
+	pattern = path.Clean(strings.TrimPrefix(pattern, "./"))
+
+	for current := file; current != "." && current != "/"; current = path.Dir(current) {
+		if matched, err := path.Match(pattern, current); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/state"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// switchedComponent is a component this deployment put live, kept so it can be put back
+type switchedComponent struct {
+	// result is the component's entry in the deployment record
+	result int
+	client *clientBuild
+	server *serverBuild
+}
+
+// deploy the components of a monorepo in dependency order. The first failure stops the deployment
+// and the components switched before it are put back on what ran before, so clients and servers
+// never stay live from two different commits
+func (e *Executor) deployComponents() error {
+	apps, err := config.Components(e.ctx.Config)
+	if err != nil {
+		return err
+	}
+
+	files, since, diffed := e.changedFiles()
+	if diffed {
+		e.log.Infof("Changed files since %s: %d", since[:7], len(files))
+	}
+
+	var (
+		deployErr error
+		switched  []switchedComponent
+	)
+	for i, app := range apps {
+		result := state.ComponentResult{Name: app.Component}
+		step := fmt.Sprintf("Component %d/%d", i+1, len(apps))
+
+		switch {
+		case deployErr != nil:
+			result.Result = state.ResultSkipped
+			e.log.Warningf("%s: Skipping %s, an earlier component failed", step, app.Component)
+
+		case diffed && !componentChanged(app.ServerDir, app.ServerPaths, files):
+			result.Result = state.ResultUnchanged
+			e.log.Infof("%s: Skipping %s, nothing under %s or its paths changed", step, app.Component, app.ServerDir)
+
+		default:
+			e.log.Infof("%s: Deploying %s (%s)...", step, app.Component, app.ProjectType)
+
+			deployed := switchedComponent{result: len(e.record.Components)}
+			if app.ProjectType == types.ProjectTypeClient {
+				deployed.client, err = e.deployComponentClient(app)
+			} else {
+				deployed.server, err = e.deployComponentServer(app)
+			}
+
+			if err != nil {
+				result.Result = state.ResultFailed
+				result.Error = err.Error()
+				deployErr = fmt.Errorf("component %s: %w", app.Component, err)
+			} else {
+				result.Result = state.ResultSuccess
+				switched = append(switched, deployed)
+				e.log.Successf("Component %s deployed", app.Component)
+			}
+		}
+
+		e.record.Components = append(e.record.Components, result)
+		e.saveRecord()
+	}
+
+	if deployErr != nil {
+		e.revertComponents(switched)
+		return deployErr
+	}
+
+	e.log.Success("All components deployed successfully!")
+	return nil
+}
+
+// build and switch a client component, returning the build when it went live
+func (e *Executor) deployComponentClient(app *types.RepoConfig) (*clientBuild, error) {
+	e.setState(types.StateDeployingClient)
+
+	client, err := e.buildClient(context.Background(), e.log, app, app.Component)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.switchClient(client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// build and switch a server component, returning the build when it went live
+func (e *Executor) deployComponentServer(app *types.RepoConfig) (*serverBuild, error) {
+	e.setState(types.StateDeployingServer)
+
+	server, err := e.buildServer(context.Background(), e.log, app, app.Component)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.switchServer(server); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// put the components switched before a failure back on what ran before this deployment, the last
+// switched first: clients on the release they replaced, servers rebuilt from the last commit that
+// went live
+func (e *Executor) revertComponents(switched []switchedComponent) {
+	if len(switched) == 0 {
+		return
+	}
+
+	e.setState(types.StateRollingBack)
+	e.log.Warningf("Reverting %d component(s) deployed before the failure...", len(switched))
+
+	previousCommit := ""
+	if previous, err := e.store.LastSuccessful(e.ctx.RepoName, e.ctx.Config.Environment); err != nil {
+		e.log.Warningf("Failed to read the last successful deployment: %v", err)
+	} else if previous != nil {
+		previousCommit = previous.DeployedCommit
+	}
+
+	for i := len(switched) - 1; i >= 0; i-- {
+		c := switched[i]
+		result := &e.record.Components[c.result]
+
+		var err error
+		switch {
+		case c.client != nil && c.client.previous == "":
+			err = fmt.Errorf("it has no earlier release")
+		case c.client != nil:
+			err = c.client.builder.Rollback(c.client.previous)
+		case previousCommit == "":
+			err = fmt.Errorf("no earlier deployment went live")
+		default:
+			err = e.restoreServer(c.server, previousCommit)
+		}
+
+		if err != nil {
+			result.Error = fmt.Sprintf("not reverted: %v", err)
+			e.log.Errorf("Failed to revert component %s: %v", result.Name, err)
+		} else {
+			result.Result = state.ResultReverted
+			e.log.Successf("Component %s reverted", result.Name)
+		}
+		e.saveRecord()
+	}
+
+	if previousCommit != "" {
+		e.record.RolledBackTo = previousCommit
+	}
+}
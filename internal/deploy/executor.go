@@ -1,46 +1,184 @@
 package deploy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/Brayzonn/deploy-agent/internal/build"
 	"github.com/Brayzonn/deploy-agent/internal/config"
 	"github.com/Brayzonn/deploy-agent/internal/git"
 	"github.com/Brayzonn/deploy-agent/internal/health"
+	"github.com/Brayzonn/deploy-agent/internal/hooks"
+	"github.com/Brayzonn/deploy-agent/internal/lock"
 	"github.com/Brayzonn/deploy-agent/internal/logger"
 	"github.com/Brayzonn/deploy-agent/internal/nginx"
+	"github.com/Brayzonn/deploy-agent/internal/preview"
+	"github.com/Brayzonn/deploy-agent/internal/provider"
+	"github.com/Brayzonn/deploy-agent/internal/release"
 	"github.com/Brayzonn/deploy-agent/internal/ssl"
+	"github.com/Brayzonn/deploy-agent/internal/state"
 	"github.com/Brayzonn/deploy-agent/pkg/types"
 )
 
 type Executor struct {
-	ctx    *types.DeploymentContext
-	cfg    *config.Config
-	log    *logger.Logger
-	git    *git.GitManager
-	stashed bool
+	ctx      *types.DeploymentContext
+	cfg      *config.Config
+	log      *logger.Logger
+	git      *git.GitManager
+	stashed  bool
+	store    *state.Store
+	record   *state.Record
+	upToDate bool
+	repoLock *lock.RepoLock
+	previews *preview.Store
+
+	// set for branch previews, holds the preview's port
+	previewRecord *preview.Record
+
+	// the directories built so far, for the outcome hooks of their .deploy.yml
+	components   []*component
+	componentsMu sync.Mutex
+
+	// the install hashes of the deployment target's directories
+	installs *build.InstallCache
+
+	// the clients switched so far, their old releases are pruned once the deployment succeeded
+	clients []*clientBuild
+
+	targetCommit   string
+	previousCommit string
 }
 
 func New(ctx *types.DeploymentContext, cfg *config.Config, log *logger.Logger) *Executor {
 	gitManager := git.New(ctx.Config.RepoDir, ctx.Branch, log)
 	
 	return &Executor{
-		ctx:     ctx,
-		cfg:     cfg,
-		log:     log,
-		git:     gitManager,
-		stashed: false,
+		ctx:      ctx,
+		cfg:      cfg,
+		log:      log,
+		git:      gitManager,
+		stashed:  false,
+		store:    state.NewStore(cfg.StateDir),
+		record:   state.NewRecord(ctx, log.FilePath()),
+		repoLock: lock.New(cfg.StateDir, ctx.Config.Target(), ctx.DeploymentID),
+		previews: preview.NewStore(cfg.StateDir),
+		installs: build.NewInstallCache(cfg.StateDir, ctx.Config.Target()),
 	}
 }
 
+// Execute runs the deployment and writes its record to the state directory
 func (e *Executor) Execute() error {
-	e.log.State(types.StateStarting)
-	e.log.Infof("Starting deployment for %s", e.ctx.RepoName)
+	err := e.acquireLock()
+	if err == nil {
+		defer e.repoLock.Release()
+		err = e.execute()
+	}
+
+	// Only a commit that actually went live counts as deployed
+	if err == nil {
+		if commit, commitErr := e.git.GetCurrentCommit(); commitErr == nil {
+			e.record.DeployedCommit = commit
+		}
+	}
+
+	// Every deployment of a preview keeps it alive for another TTL
+	if err == nil && e.previewRecord != nil {
+		if deployedErr := e.previews.Deployed(e.previewRecord, e.ctx.Config.Preview.TTL); deployedErr != nil {
+			e.log.Warningf("Failed to update preview record: %v", deployedErr)
+		}
+	}
+
+	switch {
+	case errors.Is(err, lock.ErrSuperseded):
+		e.setState(types.StateSuperseded)
+		e.record.Finish(state.ResultSuperseded, nil)
+	case err != nil:
+		e.setState(types.StateFailed)
+		e.record.Finish(state.ResultFailed, err)
+	case e.upToDate:
+		e.record.Finish(state.ResultUpToDate, nil)
+	default:
+		e.record.Finish(state.ResultSuccess, nil)
+	}
+
+	switch e.record.Result {
+	case state.ResultSuccess:
+		e.pruneReleases()
+		e.runOutcomeHooks(types.HookOnSuccess)
+	case state.ResultFailed:
+		e.runOutcomeHooks(types.HookOnFailure)
+	}
+
+	e.saveRecord()
+	return err
+}
+
+// take the repository lock so concurrent pushes never touch the same directories
+func (e *Executor) acquireLock() error {
+	policyName := e.cfg.LockPolicy
+	if e.ctx.Config.LockPolicy != "" {
+		policyName = e.ctx.Config.LockPolicy
+	}
+	if e.ctx.LockPolicy != "" {
+		policyName = e.ctx.LockPolicy
+	}
+
+	policy, err := lock.ParsePolicy(policyName)
+	if err != nil {
+		return err
+	}
+
+	err = e.repoLock.Acquire(policy, e.cfg.LockTimeout, func(holder string) {
+		e.setState(types.StateWaitingForLock)
+		e.log.Warningf("Another deployment of %s is running (%s), lock policy: %s", e.ctx.Config.Target(), holder, policy)
+	})
+
+	if errors.Is(err, lock.ErrSuperseded) {
+		e.log.Warning("A newer push arrived while waiting, skipping this deployment")
+	}
+
+	return err
+}
+
+// log a state change and persist it in the deployment record
+func (e *Executor) setState(deploymentState types.DeploymentState) {
+	e.log.State(deploymentState)
+	e.record.AddTransition(deploymentState)
+	e.saveRecord()
+}
+
+func (e *Executor) saveRecord() {
+	if err := e.store.Save(e.record); err != nil {
+		e.log.Warningf("Failed to save deployment record: %v", err)
+	}
+}
+
+func (e *Executor) execute() error {
+	e.setState(types.StateStarting)
+	e.log.Infof("Starting deployment for %s", e.ctx.Config.Target())
 	e.log.Infof("Branch: %s | Type: %s | Docker: %t | Fullstack: %t", 
 		e.ctx.Branch, e.ctx.Config.ProjectType, e.ctx.Config.UseDocker, e.ctx.Config.FullStack)
+	if len(e.ctx.Config.Components) > 0 {
+		e.log.Infof("Components: %d", len(e.ctx.Config.Components))
+	}
+
+	cloneURL, err := provider.CloneURL(e.ctx.Config, e.ctx.RepoFullName)
+	if err != nil {
+		return err
+	}
 
-	if err := e.git.CloneIfMissing(e.ctx.RepoFullName); err != nil {
+	var cloned bool
+	if e.ctx.Config.Preview != nil {
+		cloned, err = e.preparePreview(cloneURL)
+	} else {
+		cloned, err = e.git.CloneIfMissing(cloneURL)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to clone repository: %w", err)
 	}
 	
@@ -54,54 +192,159 @@ func (e *Executor) Execute() error {
 		return err
 	}
 
-	// Fetch and check for updates
-	e.log.State(types.StateFetching)
-	if err := e.git.Fetch(); err != nil {
-		return fmt.Errorf("git fetch failed: %w", err)
+	if err := e.runHooks(types.HookBeforeFetch, nil); err != nil {
+		e.restoreStash()
+		return err
+	}
+
+	// Fetch and check for updates, a preview's worktree was fetched under the checkout's lock
+	e.setState(types.StateFetching)
+	if e.ctx.Config.Preview == nil {
+		if err := e.git.Fetch(); err != nil {
+			return fmt.Errorf("git fetch failed: %w", err)
+		}
+	}
+
+	targetCommit, err := e.resolveTargetCommit()
+	if err != nil {
+		e.restoreStash()
+		return err
+	}
+	e.targetCommit = targetCommit
+
+	if previousCommit, err := e.git.GetCurrentCommit(); err == nil {
+		e.previousCommit = previousCommit
 	}
 
-	hasUpdates, err := e.git.CheckForUpdates()
+	hasUpdates, err := e.git.CheckForUpdates(targetCommit)
 	if err != nil {
+		e.restoreStash()
 		return fmt.Errorf("failed to check for updates: %w", err)
 	}
 
-	if !hasUpdates {
+	// A fresh clone is already at the tip but has never been built
+	if !hasUpdates && !e.ctx.Force && !cloned {
 		e.log.Success("No changes to deploy. Your site is up to date!")
-		if e.stashed {
-			e.git.PopStash()
-		}
+		e.upToDate = true
+		e.restoreStash()
 		return nil
 	}
 
-	// Pull latest changes
-	e.log.State(types.StatePulling)
-	if err := e.git.Pull(); err != nil {
-		if e.stashed {
-			e.log.Warning("Pull failed. Attempting to restore stash and retry...")
-			e.git.PopStash()
-			e.stashed = false
+	if hasUpdates {
+		// Check out the exact commit to deploy
+		e.setState(types.StatePulling)
+		if err := e.git.Checkout(targetCommit); err != nil {
+			if e.stashed {
+				e.log.Warning("Checkout failed. Attempting to restore stash...")
+			}
+			e.restoreStash()
+			return fmt.Errorf("git checkout failed: %w", err)
 		}
-		return fmt.Errorf("git pull failed: %w", err)
+	} else if cloned {
+		e.log.Infof("Fresh checkout, deploying %s", targetCommit[:7])
+	} else {
+		// Forced runs rebuild the commit that is already checked out
+		e.setState(types.StateForced)
+		e.log.Warningf("No new commits, forcing a redeploy of %s", targetCommit[:7])
 	}
 
 	// Restore stashed changes
-	if e.stashed {
-		e.git.PopStash()
+	e.restoreStash()
+
+	if err := e.runHooks(types.HookAfterPull, nil); err != nil {
+		return err
 	}
 
 	if err := e.deploy(); err != nil {
 		return err
 	}
 
-	e.log.State(types.StateSuccess)
+	e.setState(types.StateSuccess)
 	e.log.Success("Deployment completed successfully!")
-	e.log.Successf("Deployed %s (%s) to %s branch", e.ctx.RepoName, e.ctx.Commit[:7], e.ctx.Branch)
+	e.log.Successf("Deployed %s (%s) to %s branch", e.ctx.RepoName, e.targetCommit[:7], e.ctx.Branch)
 
 	return nil
 }
 
+// check the preview branch out as a worktree of the repository's main checkout and give it a port
+func (e *Executor) preparePreview(cloneURL string) (bool, error) {
+	previewConfig := e.ctx.Config.Preview
+	e.log.Infof("Preview of %s at %s", previewConfig.Branch, e.ctx.Config.Domain)
+
+	// The worktree shares the checkout's .git, whose deployment must not fetch at the same time
+	baseLock := lock.New(e.cfg.StateDir, previewConfig.BaseTarget, e.ctx.DeploymentID)
+	err := baseLock.Acquire(lock.PolicyWait, e.cfg.LockTimeout, func(holder string) {
+		e.log.Warningf("Waiting for the deployment of %s using the checkout (%s)", previewConfig.BaseTarget, holder)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer baseLock.Release()
+
+	base := git.New(previewConfig.BaseDir, "", e.log)
+	if _, err := base.CloneIfMissing(cloneURL); err != nil {
+		return false, err
+	}
+
+	// The worktree starts at origin/<branch>, which only exists after a fetch
+	if err := base.Fetch(); err != nil {
+		return false, err
+	}
+
+	record, err := e.previews.Allocate(e.ctx.Config)
+	if err != nil {
+		return false, err
+	}
+	e.previewRecord = record
+	e.ctx.Config.Port = record.Port
+	if record.Port > 0 {
+		e.log.Infof("Preview port: %d", record.Port)
+	}
+
+	return base.AddWorktree(e.ctx.Config.RepoDir, previewConfig.Branch)
+}
+
+// environment handed to a preview's server so it listens on the preview's port
+func (e *Executor) previewEnv() []string {
+	return []string{fmt.Sprintf("PORT=%d", e.ctx.Config.Port)}
+}
+
+// resolve the commit to deploy and make sure it belongs to the branch being deployed
+func (e *Executor) resolveTargetCommit() (string, error) {
+	targetCommit, err := e.git.ResolveCommit(e.ctx.Commit)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve commit: %w", err)
+	}
+
+	if err := e.git.VerifyOnBranch(targetCommit); err != nil {
+		return "", err
+	}
+
+	if behind, err := e.git.CommitsBehind(targetCommit); err == nil && behind > 0 {
+		e.log.Warningf("Deploying %s, which is %d commit(s) behind the tip of %s", targetCommit[:7], behind, e.ctx.Branch)
+	} else {
+		e.log.Infof("Deploying commit %s", targetCommit[:7])
+	}
+
+	return targetCommit, nil
+}
+
+// pop the auto stash if one was made
+func (e *Executor) restoreStash() {
+	if e.stashed {
+		e.git.PopStash()
+		e.stashed = false
+	}
+}
+
 // stash any uncommitted changes
 func (e *Executor) handleUncommittedChanges() error {
+	// refs/stash is shared by every worktree, a preview's stash could be popped by the checkout's
+	// deployment. The agent creates preview worktrees itself, nothing in them needs keeping
+	if e.ctx.Config.Preview != nil {
+		return nil
+	}
+
 	hasChanges, err := e.git.HasUncommittedChanges()
 	if err != nil {
 		return fmt.Errorf("failed to check for uncommitted changes: %w", err)
@@ -130,16 +373,20 @@ func (e *Executor) deploy() error {
 		return e.deployFullstack()
 	}
 
+	if len(e.ctx.Config.Components) > 0 {
+		return e.deployComponents()
+	}
+
 	if e.ctx.Config.ProjectType == types.ProjectTypeClient {
-		return e.deployClient()
+		return e.deployClient(e.ctx.Config, "client")
 	}
 
-	return e.deployServer()
+	return e.deployServer(e.ctx.Config, "server")
 }
 
 //  deploy using Docker
 func (e *Executor) deployDocker() error {
-	e.log.State(types.StateBuildingDocker)
+	e.setState(types.StateBuildingDocker)
 	e.log.Info("Deploying with Docker...")
 
 	workDir := e.ctx.Config.RepoDir
@@ -151,6 +398,12 @@ func (e *Executor) deployDocker() error {
 	e.log.Infof("Compose file: %s", e.ctx.Config.DockerComposeFile)
 	e.log.Infof("Env file: %s", e.ctx.Config.DockerEnvFile)
 
+	// Compose builds the images, the pipeline only contributes hooks and the health check
+	docker, err := e.loadComponent(context.Background(), e.log, "docker", workDir, e.ctx.Config)
+	if err != nil {
+		return err
+	}
+
 	dockerBuilder := build.NewDockerBuilder(
 		workDir,
 		e.ctx.Config.DockerComposeFile,
@@ -158,6 +411,22 @@ func (e *Executor) deployDocker() error {
 		e.log,
 	)
 
+	// Previews share the compose file, their own project keeps them apart from production
+	if e.ctx.Config.Preview != nil {
+		dockerBuilder.SetProject(e.ctx.Config.Preview.Project, e.previewEnv())
+	}
+
+	// Keep the running images so a failed deploy can go back to them
+	if e.previousCommit != "" {
+		if err := dockerBuilder.TagRunningImages(e.ctx.Config.Target(), e.previousCommit); err != nil {
+			e.log.Warningf("Failed to tag running images, rollback will not be possible: %v", err)
+		}
+	}
+
+	if err := e.runHooks(types.HookBeforeBuild, docker); err != nil {
+		return err
+	}
+
 	buildResult, err := dockerBuilder.Build()
 	if err != nil {
 		e.log.Errorf("Docker build failed: %v", err)
@@ -166,7 +435,15 @@ func (e *Executor) deployDocker() error {
 
 	e.log.Successf("Docker build completed in %v", buildResult.Duration)
 
-	e.log.State(types.StateDeployingDocker)
+	if err := e.runHooks(types.HookAfterBuild, docker); err != nil {
+		return err
+	}
+
+	if err := e.runHooks(types.HookBeforeSwitch, docker); err != nil {
+		return err
+	}
+
+	e.setState(types.StateDeployingDocker)
 	if err := dockerBuilder.Deploy(); err != nil {
 		e.log.Errorf("Docker deployment failed: %v", err)
 		
@@ -174,13 +451,11 @@ func (e *Executor) deployDocker() error {
 		e.log.Error("Container logs:")
 		e.log.Error(logs)
 		
-		e.log.Warning("Attempting rollback...")
-		dockerBuilder.Rollback()
-		return fmt.Errorf("docker deployment failed: %w", err)
+		return e.rollbackDocker(dockerBuilder, fmt.Errorf("docker deployment failed: %w", err))
 	}
 
 	if e.ctx.Config.RequiresMigrations {
-		e.log.State(types.StateRunningMigrations)
+		e.setState(types.StateRunningMigrations)
 		if err := dockerBuilder.RunMigrations(e.ctx.Config.MigrationCommand); err != nil {
 			e.log.Errorf("Migrations failed: %v", err)
 			
@@ -188,11 +463,16 @@ func (e *Executor) deployDocker() error {
 			e.log.Error("API container logs:")
 			e.log.Error(logs)
 			
-			return fmt.Errorf("migrations failed: %w", err)
+			e.log.Warning("Migrations that were already applied are not reverted")
+			return e.rollbackDocker(dockerBuilder, fmt.Errorf("migrations failed: %w", err))
 		}
 		e.log.Success("Database migrations completed")
 	}
 
+	if err := e.runHooks(types.HookAfterSwitch, docker); err != nil {
+		return e.rollbackDocker(dockerBuilder, err)
+	}
+
 	if e.ctx.Config.Domain != "" && e.ctx.Config.Port > 0 {
 		nginxMgr := nginx.New(
 			e.ctx.Config.Domain,
@@ -221,206 +501,654 @@ func (e *Executor) deployDocker() error {
 
 	if err := dockerBuilder.CheckHealth(); err != nil {
 		e.log.Errorf("Container health check failed: %v", err)
-		return fmt.Errorf("health check failed: %w", err)
+		return e.rollbackDocker(dockerBuilder, fmt.Errorf("health check failed: %w", err))
 	}
 
-	if e.ctx.Config.HealthCheckURL != "" {
+	if docker.pipeline.HealthCheck.URL != "" {
 		healthChecker := health.New(
 			e.ctx.Config.Domain,
 			e.ctx.Config.Port,
-			e.ctx.RepoName,
+			e.ctx.Config.PM2AppName,
 			e.ctx.Config.ProjectType,
 			e.log,
 		)
+		setHealthCheck(healthChecker, docker.pipeline)
 
 		if err := healthChecker.Check(); err != nil {
-			e.log.Warningf("HTTP health check failed: %v", err)
-		} else {
-			e.log.Success("HTTP health check passed")
+			e.log.Errorf("HTTP health check failed: %v", err)
+			return e.rollbackDocker(dockerBuilder, fmt.Errorf("health check failed: %w", err))
 		}
+		e.log.Success("HTTP health check passed")
 	}
 
 	e.log.Success("Docker deployment completed successfully!")
 	return nil
 }
 
+// bring the containers that ran before this deploy back up, then return the deployment error
+func (e *Executor) rollbackDocker(dockerBuilder *build.DockerBuilder, deployErr error) error {
+	e.setState(types.StateRollingBack)
+	e.log.Warning("Attempting rollback...")
+
+	// The old images are brought up with the old commit's compose file, the failed one's services,
+	// env and volumes must not be applied to them
+	if e.previousCommit != "" && e.previousCommit != e.targetCommit {
+		if err := e.git.Checkout(e.previousCommit); err != nil {
+			e.log.Errorf("Rollback failed: %v", err)
+			return fmt.Errorf("deployment failed and rollback failed: %w, rollback error: %v", deployErr, err)
+		}
+	}
+
+	if err := dockerBuilder.Rollback(); err != nil {
+		e.log.Errorf("Rollback failed: %v", err)
+		return fmt.Errorf("deployment failed and rollback failed: %w, rollback error: %v", deployErr, err)
+	}
+
+	e.record.RolledBackTo = e.previousCommit
+	e.log.Success("Rollback completed - previous containers restored")
+	return deployErr
+}
+
+// clientBuild is a client that was built and tested and waits for its switch
+type clientBuild struct {
+	app       *types.RepoConfig
+	component *component
+	builder   *build.ClientBuilder
+	output    *types.BuildOutput
+	// previous is the release the switch replaced
+	previous string
+}
+
 //  deploy a frontend-only project
-func (e *Executor) deployClient() error {
-	e.log.State(types.StateDeployingClient)
+func (e *Executor) deployClient(app *types.RepoConfig, name string) error {
+	e.setState(types.StateDeployingClient)
 	e.log.Info("Deploying client application...")
 
+	client, err := e.buildClient(context.Background(), e.log, app, name)
+	if err != nil {
+		return err
+	}
+
+	return e.switchClient(client)
+}
+
+// install, build and test a client without touching what is live
+func (e *Executor) buildClient(ctx context.Context, log *logger.Logger, app *types.RepoConfig, name string) (*clientBuild, error) {
 	// Determine client directory
-	clientDir := e.ctx.Config.RepoDir
-	if e.ctx.Config.ClientDir != "" && e.ctx.Config.ClientDir != "." {
-		clientDir = filepath.Join(e.ctx.Config.RepoDir, e.ctx.Config.ClientDir)
+	clientDir := app.RepoDir
+	if app.ClientDir != "" && app.ClientDir != "." {
+		clientDir = filepath.Join(app.RepoDir, app.ClientDir)
+	}
+
+	log.Infof("Client directory: %s", clientDir)
+
+	client, err := e.loadComponent(ctx, log, name, clientDir, app)
+	if err != nil {
+		return nil, err
 	}
 
-	e.log.Infof("Client directory: %s", clientDir)
+	if err := e.resolveNode(client); err != nil {
+		return nil, err
+	}
+
+	if err := e.runHooks(types.HookBeforeBuild, client); err != nil {
+		return nil, err
+	}
 
 	// Build client
-	clientBuilder := build.NewClientBuilder(clientDir, e.ctx.Config.WebRoot, e.log)
+	clientBuilder := build.NewClientBuilder(clientDir, app.WebRoot, app.KeepReleases, log)
+	clientBuilder.SetPipeline(client.pipeline)
+	clientBuilder.SetNode(client.node)
+	clientBuilder.SetInstallCache(e.installs, e.ctx.CleanInstall)
+	clientBuilder.SetContext(ctx)
 	buildResult, err := clientBuilder.Build()
 	if err != nil {
-		return fmt.Errorf("client build failed: %w", err)
+		return nil, fmt.Errorf("client build failed: %w", err)
+	}
+
+	if err := clientBuilder.Verify(); err != nil {
+		return nil, fmt.Errorf("client tests failed: %w", err)
+	}
+
+	if err := e.runHooks(types.HookAfterBuild, client); err != nil {
+		return nil, err
+	}
+
+	return &clientBuild{app: app, component: client, builder: clientBuilder, output: buildResult}, nil
+}
+
+// switch the web root to the built release and check the site, going back to the release it
+// replaced when anything after the switch fails
+func (e *Executor) switchClient(b *clientBuild) error {
+	app, client, clientBuilder, log := b.app, b.component, b.builder, b.component.log
+
+	if err := e.runHooks(types.HookBeforeSwitch, client); err != nil {
+		return err
+	}
+
+	// Switch the web root to a new release (get the release it replaced)
+	previousRelease, err := clientBuilder.Deploy(b.output.OutputDir, e.ctx.DeploymentID)
+	if err != nil {
+		return fmt.Errorf("client deployment failed: %w", err)
+	}
+	b.previous = previousRelease
+	e.clients = append(e.clients, b)
+
+	if err := e.runHooks(types.HookAfterSwitch, client); err != nil {
+		return e.rollbackClient(clientBuilder, previousRelease, err)
 	}
 
-	if e.ctx.Config.Domain != "" {
+	if app.Domain != "" {
 		nginxMgr := nginx.New(
-			e.ctx.Config.Domain,
-			e.ctx.Config.DomainAliases,
-			e.ctx.Config.WebRoot,
-			e.ctx.Config.ProjectType,
-			e.ctx.Config.Port,
-			e.log,
+			app.Domain,
+			app.DomainAliases,
+			release.CurrentLink(app.WebRoot),
+			app.ProjectType,
+			app.Port,
+			log,
 		)
+
+		// A fullstack repository with api_path serves its server on the client's domain
+		if app.FullStack && app.APIPath != "" {
+			nginxMgr.SetAPIProxy(app.APIPath, app.FullstackServer().Port)
+		}
+
+		// Sites set up before releases served the web root itself
+		if err := nginxMgr.MigrateRoot(app.WebRoot); err != nil {
+			log.Warningf("Nginx root migration failed: %v", err)
+		}
 		
 		if err := nginxMgr.Setup(); err != nil {
-			e.log.Warningf("Nginx setup failed: %v", err)
+			log.Warningf("Nginx setup failed: %v", err)
 		}
 
 		sslMgr := ssl.New(
-			e.ctx.Config.Domain,
-			e.ctx.Config.DomainAliases,
+			app.Domain,
+			app.DomainAliases,
 			e.cfg.SSLEmail,
-			e.log,
+			log,
 		)
 		
 		if err := sslMgr.Setup(); err != nil {
-			e.log.Warningf("SSL setup failed: %v", err)
+			log.Warningf("SSL setup failed: %v", err)
 		}
 	}
 
-	// Deploy to web root (get backup path)
-	backupDir, err := clientBuilder.Deploy(buildResult.OutputDir)
-	if err != nil {
-		return fmt.Errorf("client deployment failed: %w", err)
-	}
-
 	healthChecker := health.New(
-		e.ctx.Config.Domain,
+		app.Domain,
 		0, 
 		"", 
-		e.ctx.Config.ProjectType,
-		e.log,
+		app.ProjectType,
+		log,
 	)
+	setHealthCheck(healthChecker, client.pipeline)
 
 	if err := healthChecker.Check(); err != nil {
-		e.log.Errorf("Health check failed: %v", err)
-		if backupDir != "" {
-			e.log.Warning("Attempting automatic rollback...")
-			if rollbackErr := clientBuilder.RestoreFromBackup(backupDir); rollbackErr != nil {
-				e.log.Errorf("Rollback failed: %v", rollbackErr)
-				return fmt.Errorf("deployment failed and rollback failed: health check error: %w, rollback error: %v", err, rollbackErr)
-			}
-			e.log.Success("Rollback completed - previous deployment restored")
-		}
-		return fmt.Errorf("deployment health check failed: %w", err)
+		log.Errorf("Health check failed: %v", err)
+		return e.rollbackClient(clientBuilder, previousRelease, fmt.Errorf("deployment health check failed: %w", err))
 	}
 
 	return nil
 }
 
+// remove the old releases of the clients this deployment switched, keeping the ones they replaced
+// so a later rollback still has them
+func (e *Executor) pruneReleases() {
+	for _, client := range e.clients {
+		client.builder.Releases().Prune(client.previous)
+	}
+}
+
+// switch the web root back to the release this deploy replaced, then return the deployment error
+func (e *Executor) rollbackClient(clientBuilder *build.ClientBuilder, previousRelease string, deployErr error) error {
+	if previousRelease == "" {
+		return deployErr
+	}
+
+	e.log.Warning("Attempting automatic rollback...")
+	if err := clientBuilder.Rollback(previousRelease); err != nil {
+		e.log.Errorf("Rollback failed: %v", err)
+		return fmt.Errorf("deployment failed and rollback failed: %w, rollback error: %v", deployErr, err)
+	}
+
+	e.log.Success("Rollback completed - previous deployment restored")
+	return deployErr
+}
+
+// serverBuild is a server that was built and tested and waits for its switch
+type serverBuild struct {
+	app       *types.RepoConfig
+	component *component
+	builder   *build.ServerBuilder
+	output    *types.BuildOutput
+	// healthChecker is set by the switch, a later failure rolls the server back with it
+	healthChecker *health.HealthChecker
+}
+
 //  deploys a backend-only project
-func (e *Executor) deployServer() error {
-	e.log.State(types.StateDeployingServer)
+func (e *Executor) deployServer(app *types.RepoConfig, name string) error {
+	e.setState(types.StateDeployingServer)
 	e.log.Info("Deploying server API...")
 
-	serverDir := filepath.Join(e.ctx.Config.RepoDir, e.ctx.Config.ServerDir)
-	e.log.Infof("Server directory: %s", serverDir)
+	server, err := e.buildServer(context.Background(), e.log, app, name)
+	if err != nil {
+		return err
+	}
+
+	return e.switchServer(server)
+}
+
+// install, build and test a server without touching the running app
+func (e *Executor) buildServer(ctx context.Context, log *logger.Logger, app *types.RepoConfig, name string) (*serverBuild, error) {
+	serverDir := filepath.Join(app.RepoDir, app.ServerDir)
+	log.Infof("Server directory: %s", serverDir)
+
+	server, err := e.loadComponent(ctx, log, name, serverDir, app)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.resolveNode(server); err != nil {
+		return nil, err
+	}
 
 	// Build server
 	serverBuilder := build.NewServerBuilder(
 		serverDir,
-		e.ctx.Config.ProjectType,
-		e.ctx.RepoName,
-		e.ctx.Config.ServerEntry,
-		e.ctx.Config.PM2Ecosystem,
-		e.log,
+		app.ProjectType,
+		app.PM2AppName,
+		app.ServerEntry,
+		app.PM2Ecosystem,
+		log,
 	)
 
+	// The ecosystem file describes production's app, a preview runs the entry on its own port
+	if app.Preview != nil {
+		serverBuilder.RunAsScript(e.previewEnv())
+	}
+	serverBuilder.SetPipeline(server.pipeline)
+	serverBuilder.SetNode(server.node)
+	serverBuilder.SetInstallCache(e.installs, e.ctx.CleanInstall)
+	serverBuilder.SetContext(ctx)
+
+	if err := e.runHooks(types.HookBeforeBuild, server); err != nil {
+		return nil, err
+	}
+
 	buildResult, err := serverBuilder.Build()
 	if err != nil {
-		return fmt.Errorf("server build failed: %w", err)
+		return nil, fmt.Errorf("server build failed: %w", err)
 	}
 
-	if e.ctx.Config.Domain != "" && e.ctx.Config.Port > 0 {
+	if err := serverBuilder.Verify(); err != nil {
+		return nil, fmt.Errorf("server tests failed: %w", err)
+	}
+
+	if err := e.runHooks(types.HookAfterBuild, server); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Server build completed in %v", buildResult.Duration)
+	return &serverBuild{app: app, component: server, builder: serverBuilder, output: buildResult}, nil
+}
+
+// restart the PM2 app on the build and check it, going back to the last commit that went live
+// when anything after the switch fails
+func (e *Executor) switchServer(b *serverBuild) error {
+	app, server, serverBuilder, log := b.app, b.component, b.builder, b.component.log
+
+	if app.Domain != "" && app.Port > 0 {
 		nginxMgr := nginx.New(
-			e.ctx.Config.Domain,
-			e.ctx.Config.DomainAliases,
+			app.Domain,
+			app.DomainAliases,
 			"", 
-			e.ctx.Config.ProjectType,
-			e.ctx.Config.Port,
-			e.log,
+			app.ProjectType,
+			app.Port,
+			log,
 		)
 		
 		if err := nginxMgr.Setup(); err != nil {
-			e.log.Warningf("Nginx setup failed: %v", err)
+			log.Warningf("Nginx setup failed: %v", err)
 		}
 
 		sslMgr := ssl.New(
-			e.ctx.Config.Domain,
-			e.ctx.Config.DomainAliases,
+			app.Domain,
+			app.DomainAliases,
 			e.cfg.SSLEmail,
-			e.log,
+			log,
 		)
 		
 		if err := sslMgr.Setup(); err != nil {
-			e.log.Warningf("SSL setup failed: %v", err)
+			log.Warningf("SSL setup failed: %v", err)
 		}
 	}
 
+	healthChecker := health.New(
+		app.Domain,
+		app.Port,
+		app.PM2AppName,
+		app.ProjectType,
+		log,
+	)
+	setHealthCheck(healthChecker, server.pipeline)
+	b.healthChecker = healthChecker
+
+	if err := e.runHooks(types.HookBeforeSwitch, server); err != nil {
+		return err
+	}
+
 	// Deploy with PM2
+	if err := serverBuilder.Deploy(server.dir); err != nil {
+		log.Errorf("PM2 deployment failed: %v", err)
+		return e.rollbackServer(b, fmt.Errorf("server deployment failed: %w", err))
+	}
+
+	if err := e.runHooks(types.HookAfterSwitch, server); err != nil {
+		return e.rollbackServer(b, err)
+	}
+
+	if err := healthChecker.Check(); err != nil {
+		log.Errorf("Health check failed: %v", err)
+		return e.rollbackServer(b, fmt.Errorf("deployment health check failed: %w", err))
+	}
+
+	return nil
+}
+
+// check out, rebuild and restart the last commit that went live, then return the deployment error
+func (e *Executor) rollbackServer(b *serverBuild, deployErr error) error {
+	app := b.app
+
+	previous, err := e.store.LastSuccessful(e.ctx.RepoName, app.Environment)
+	if err != nil || previous == nil || previous.DeployedCommit == "" {
+		e.log.Warning("No previous successful deployment recorded, cannot roll back")
+		return deployErr
+	}
+
+	if previous.DeployedCommit == e.targetCommit {
+		e.log.Warning("The failed commit is the last one that went live, nothing to roll back to")
+		return deployErr
+	}
+
+	e.setState(types.StateRollingBack)
+	e.log.Warningf("Attempting automatic rollback to %s (%s)...", previous.DeployedCommit[:7], previous.DeploymentID)
+
+	if rollbackErr := e.restoreServer(b, previous.DeployedCommit); rollbackErr != nil {
+		e.log.Errorf("Rollback failed: %v", rollbackErr)
+		return fmt.Errorf("deployment failed and rollback failed: %w, rollback error: %v", deployErr, rollbackErr)
+	}
+
+	e.record.RolledBackTo = previous.DeployedCommit
+	e.log.Success("Rollback completed - previous deployment restored")
+	return deployErr
+}
+
+// check commit out, then rebuild, restart and check a switched server on it
+func (e *Executor) restoreServer(b *serverBuild, commit string) error {
+	app, serverBuilder, serverDir, healthChecker := b.app, b.builder, b.component.dir, b.healthChecker
+
+	if err := e.git.Checkout(commit); err != nil {
+		return err
+	}
+
+	// The old commit is built the way it was built when it went live
+	pipeline, _, err := config.LoadPipeline(serverDir, app)
+	if err != nil {
+		return err
+	}
+	serverBuilder.SetPipeline(pipeline)
+
+	node, err := build.ResolveNode(serverDir, e.cfg.NodeManager, e.cfg.NodeDir)
+	if err != nil {
+		return err
+	}
+	serverBuilder.SetNode(node)
+	// A fresh cache, the deployment's own remembers installs of the commit being rolled back
+	serverBuilder.SetInstallCache(build.NewInstallCache(e.cfg.StateDir, e.ctx.Config.Target()), false)
+
+	if _, err := serverBuilder.Build(); err != nil {
+		return fmt.Errorf("rebuild failed: %w", err)
+	}
+
 	if err := serverBuilder.Deploy(serverDir); err != nil {
-		return fmt.Errorf("server deployment failed: %w", err)
+		return err
 	}
 
-	e.log.Infof("Server build completed in %v", buildResult.Duration)
+	return healthChecker.Check()
+}
 
-	healthChecker := health.New(
-		e.ctx.Config.Domain,
-		e.ctx.Config.Port,
-		e.ctx.RepoName, 
-		e.ctx.Config.ProjectType,
-		e.log,
-	)
+// component is a directory of the checkout that is built and switched on its own
+type component struct {
+	name     string
+	dir      string
+	config   *types.RepoConfig
+	pipeline *types.Pipeline
+	// node is set for the directories built with Node, not for Docker
+	node *build.Node
+	// ctx cancels the component's build hooks, log prefixes its lines while it builds alongside another
+	ctx context.Context
+	log *logger.Logger
+}
 
-	if err := healthChecker.Check(); err != nil {
-		e.log.Errorf("Health check failed: %v", err)
-		return fmt.Errorf("deployment health check failed: %w", err)
+// read the .deploy.yml of the directory about to be built, over the config it is deployed with
+func (e *Executor) loadComponent(ctx context.Context, log *logger.Logger, name, dir string, app *types.RepoConfig) (*component, error) {
+	pipeline, found, err := config.LoadPipeline(dir, app)
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		log.Infof("Using pipeline from %s", filepath.Join(dir, config.PipelineFile))
+	}
+
+	c := &component{name: name, dir: dir, config: app, pipeline: pipeline, ctx: ctx, log: log}
+
+	e.componentsMu.Lock()
+	e.components = append(e.components, c)
+	e.componentsMu.Unlock()
+	return c, nil
+}
+
+// pick the Node install the component's .nvmrc, .node-version or engines.node ask for
+func (e *Executor) resolveNode(c *component) error {
+	node, err := build.ResolveNode(c.dir, e.cfg.NodeManager, e.cfg.NodeDir)
+	if err != nil {
+		return err
 	}
 
+	c.log.Infof("Using %s", node)
+	c.node = node
 	return nil
 }
 
+// run the hooks of a stage, the agent config's first and then those of the component's .deploy.yml.
+// Hooks of the whole deployment (c is nil) run in the repository directory
+func (e *Executor) runHooks(stage types.HookStage, c *component) error {
+	if c == nil {
+		return hooks.Run(stage, e.ctx.Config.RepoDir, e.ctx.Config.Hooks.For(stage), e.hookEnv(stage, nil), e.log)
+	}
+
+	stageHooks := append(e.ctx.Config.Hooks.For(stage), c.pipeline.Hooks.For(stage)...)
+	return hooks.RunContext(c.ctx, stage, c.dir, stageHooks, e.hookEnv(stage, c), c.log)
+}
+
+// run the on_success or on_failure hooks, the outcome is decided so a failing hook is only reported
+func (e *Executor) runOutcomeHooks(stage types.HookStage) {
+	if err := hooks.Run(stage, e.ctx.Config.RepoDir, e.ctx.Config.Hooks.For(stage), e.hookEnv(stage, nil), e.log); err != nil {
+		e.log.Warningf("%v", err)
+	}
+
+	for _, c := range e.components {
+		if err := hooks.Run(stage, c.dir, c.pipeline.Hooks.For(stage), e.hookEnv(stage, c), c.log); err != nil {
+			e.log.Warningf("%v", err)
+		}
+	}
+}
+
+// the deployment context handed to hooks
+func (e *Executor) hookEnv(stage types.HookStage, c *component) []string {
+	commit := e.targetCommit
+	if commit == "" {
+		commit = e.ctx.Commit
+	}
+
+	// A component of a monorepo has a domain and port of its own
+	app := e.ctx.Config
+	if c != nil {
+		app = c.config
+	}
+
+	env := []string{
+		"DEPLOY_STAGE=" + string(stage),
+		"DEPLOY_ID=" + e.ctx.DeploymentID,
+		"DEPLOY_REPO=" + e.ctx.RepoName,
+		"DEPLOY_REPO_OWNER=" + e.ctx.RepoOwner,
+		"DEPLOY_REPO_FULL_NAME=" + e.ctx.RepoFullName,
+		"DEPLOY_ENVIRONMENT=" + e.ctx.Config.Environment,
+		"DEPLOY_BRANCH=" + e.ctx.Branch,
+		"DEPLOY_COMMIT=" + commit,
+		"DEPLOY_PREVIOUS_COMMIT=" + e.previousCommit,
+		"DEPLOY_PUSHER=" + e.ctx.Pusher,
+		"DEPLOY_FORCED=" + strconv.FormatBool(e.ctx.Force),
+		"DEPLOY_REPO_DIR=" + e.ctx.Config.RepoDir,
+		"DEPLOY_DOMAIN=" + app.Domain,
+		"DEPLOY_PORT=" + strconv.Itoa(app.Port),
+		"DEPLOY_LOG_FILE=" + e.record.LogFile,
+		"DEPLOY_RESULT=" + string(e.record.Result),
+		"DEPLOY_ERROR=" + e.record.Error,
+	}
+
+	if c != nil {
+		env = append(env, "DEPLOY_COMPONENT="+c.name, "DEPLOY_DIR="+c.dir)
+		env = append(env, c.node.Env()...)
+		for name, value := range c.pipeline.Env {
+			env = append(env, name+"="+value)
+		}
+	}
+
+	return env
+}
+
+// check the pipeline's health check URL, with its timeout, instead of the domain
+func setHealthCheck(healthChecker *health.HealthChecker, pipeline *types.Pipeline) {
+	healthChecker.SetURL(pipeline.HealthCheck.URL, time.Duration(pipeline.HealthCheck.Timeout)*time.Second)
+}
+
 // deploy fullstack app
 func (e *Executor) deployFullstack() error {
-    e.log.State(types.StateDeployingFull)
+    e.setState(types.StateDeployingFull)
     e.log.Info("Deploying fullstack application...")
 
-    e.log.Info("Step 1/2: Deploying server...")
-    
-    originalDomain := e.ctx.Config.Domain
-    originalAliases := e.ctx.Config.DomainAliases  
-    
-    if e.ctx.Config.Domain != "" {
-        e.ctx.Config.Domain = "api." + e.ctx.Config.Domain
-        e.ctx.Config.DomainAliases = []string{} 
+    deployServer, deployClient := true, true
+    if files, since, ok := e.changedFiles(); ok {
+        deployServer = componentChanged(e.ctx.Config.ServerDir, e.ctx.Config.ServerPaths, files)
+        deployClient = componentChanged(e.ctx.Config.ClientDir, e.ctx.Config.ClientPaths, files)
+        e.log.Infof("Changed files since %s: %d", since[:7], len(files))
     }
 
-    if err := e.deployServer(); err != nil {
-        e.ctx.Config.Domain = originalDomain 
-        e.ctx.Config.DomainAliases = originalAliases  
+    if !deployServer {
+        e.log.Infof("Skipping server, nothing under %s or server_paths changed", e.ctx.Config.ServerDir)
+    }
+    if !deployClient {
+        e.log.Infof("Skipping client, nothing under %s or client_paths changed", e.ctx.Config.ClientDir)
+    }
+
+    server, client, err := e.buildFullstack(deployServer, deployClient)
+    if err != nil {
         return err
     }
 
-    e.ctx.Config.Domain = originalDomain
-    e.ctx.Config.DomainAliases = originalAliases  
+    // Only the switches run one after the other, the server first so the client never calls an old API
+    if server != nil {
+        e.setState(types.StateDeployingServer)
+        e.log.Info("Step 1/2: Switching server...")
+        if err := e.switchServer(server); err != nil {
+            return err
+        }
+    }
 
-    e.log.Info("Step 2/2: Deploying client...")
-    if err := e.deployClient(); err != nil {
-        return err
+    if client != nil {
+        e.setState(types.StateDeployingClient)
+        e.log.Info("Step 2/2: Switching client...")
+        if err := e.switchClient(client); err != nil {
+            if server != nil {
+                // The server already went live for a client that did not
+                return e.rollbackServer(server, err)
+            }
+            return err
+        }
     }
 
     e.log.Success("Fullstack deployment completed successfully!")
     return nil
-}
\ No newline at end of file
+}
+
+// build the halves of a fullstack repository at the same time, each logging with its own prefix.
+// The first build that fails cancels the other, nothing has gone live by then
+func (e *Executor) buildFullstack(deployServer, deployClient bool) (*serverBuild, *clientBuild, error) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    var (
+        wg     sync.WaitGroup
+        once   sync.Once
+        failed error
+        server *serverBuild
+        client *clientBuild
+    )
+
+    parallel := deployServer && deployClient
+    if parallel {
+        e.log.Info("Building server and client in parallel...")
+    }
+
+    fail := func(half string, err error) {
+        once.Do(func() {
+            failed = err
+            cancel()
+            if parallel {
+                e.log.Errorf("The %s build failed, cancelling the other build", half)
+            }
+        })
+    }
+
+    if deployServer {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            var err error
+            if server, err = e.buildServer(ctx, e.log.WithPrefix("[server] "), e.ctx.Config.FullstackServer(), "server"); err != nil {
+                fail("server", err)
+            }
+        }()
+    }
+
+    if deployClient {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            var err error
+            if client, err = e.buildClient(ctx, e.log.WithPrefix("[client] "), e.ctx.Config, "client"); err != nil {
+                fail("client", err)
+            }
+        }()
+    }
+
+    wg.Wait()
+
+    if failed != nil {
+        return nil, nil, failed
+    }
+
+    // The switches must not be cancelled with the builds
+    if server != nil {
+        server.component.ctx = context.Background()
+        server.builder.SetContext(context.Background())
+    }
+    if client != nil {
+        client.component.ctx = context.Background()
+        client.builder.SetContext(context.Background())
+    }
+
+    return server, client, nil
+}
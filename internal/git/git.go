@@ -1,10 +1,12 @@
 package git
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/Brayzonn/deploy-agent/internal/logger"
@@ -97,65 +99,146 @@ func (g *GitManager) Fetch() error {
 }
 
 //  clone the repository if it doesn't exist
-func (g *GitManager) CloneIfMissing(repoFullName string) error {
+func (g *GitManager) CloneIfMissing(repoURL string) (bool, error) {
 	if _, err := os.Stat(g.repoDir); err == nil {
 		g.log.Info("Repository already exists, skipping clone")
-		return nil
+		return false, nil
 	}
 
-	g.log.Warning("Repository not found, cloning from GitHub...")
-
-	repoURL := fmt.Sprintf("git@github.com:%s.git", repoFullName)
+	g.log.Warning("Repository not found, cloning...")
 	g.log.Infof("Cloning from: %s", repoURL)
 
 	parentDir := filepath.Dir(g.repoDir)
 	if err := os.MkdirAll(parentDir, 0755); err != nil {
-		return fmt.Errorf("failed to create parent directory: %w", err)
+		return false, fmt.Errorf("failed to create parent directory: %w", err)
 	}
 
-	cmd := exec.Command("git", "clone", repoURL, g.repoDir)
+	// Start on the deployed branch, an environment's checkout may never see the default branch
+	args := []string{"clone"}
+	if g.branch != "" {
+		args = append(args, "--branch", g.branch)
+	}
+	cmd := exec.Command("git", append(args, repoURL, g.repoDir)...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to clone repository: %w\nOutput: %s", err, string(output))
+		return false, fmt.Errorf("failed to clone repository: %w\nOutput: %s", err, string(output))
 	}
 
 	g.log.Successf("Repository cloned successfully to %s", g.repoDir)
+	return true, nil
+}
+
+// ResolveCommit returns the full SHA of the requested commit, or of the remote branch tip when none was requested
+func (g *GitManager) ResolveCommit(requested string) (string, error) {
+	ref := fmt.Sprintf("origin/%s", g.branch)
+	if requested != "" {
+		ref = requested
+	}
+
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	cmd.Dir = g.repoDir
+
+	output, err := cmd.Output()
+	if err != nil {
+		if requested != "" {
+			return "", fmt.Errorf("commit %s not found after fetch", requested)
+		}
+		return "", fmt.Errorf("branch %s not found on remote", g.branch)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// VerifyOnBranch checks that a commit is reachable from the remote branch, so no stray commit gets deployed
+func (g *GitManager) VerifyOnBranch(sha string) error {
+	onBranch, err := g.IsAncestor(sha, fmt.Sprintf("origin/%s", g.branch))
+	if err != nil {
+		return fmt.Errorf("failed to check commit %s against %s: %w", sha, g.branch, err)
+	}
+
+	if !onBranch {
+		return fmt.Errorf("commit %s is not on branch %s", sha, g.branch)
+	}
+
 	return nil
 }
 
-//  check if there are new commits to pull
-func (g *GitManager) CheckForUpdates() (bool, error) {
-	// Get local HEAD
-	localCmd := exec.Command("git", "rev-parse", "@")
-	localCmd.Dir = g.repoDir
-	localOutput, err := localCmd.Output()
+// IsAncestor reports whether ancestor is reachable from ref
+func (g *GitManager) IsAncestor(ancestor, ref string) (bool, error) {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", ancestor, ref)
+	cmd.Dir = g.repoDir
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CommitsBehind counts the commits on the remote branch that are newer than sha
+func (g *GitManager) CommitsBehind(sha string) (int, error) {
+	cmd := exec.Command("git", "rev-list", "--count", fmt.Sprintf("%s..origin/%s", sha, g.branch))
+	cmd.Dir = g.repoDir
+
+	output, err := cmd.Output()
 	if err != nil {
-		return false, fmt.Errorf("failed to get local HEAD: %w", err)
+		return 0, fmt.Errorf("failed to count commits: %w", err)
 	}
-	local := strings.TrimSpace(string(localOutput))
 
-	// Get remote HEAD
-	remoteCmd := exec.Command("git", "rev-parse", fmt.Sprintf("origin/%s", g.branch))
-	remoteCmd.Dir = g.repoDir
-	remoteOutput, err := remoteCmd.Output()
+	return strconv.Atoi(strings.TrimSpace(string(output)))
+}
+
+// ChangedFiles lists the files that differ between two commits, a renamed file under both names
+func (g *GitManager) ChangedFiles(from, to string) ([]string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", "--no-renames", from, to)
+	cmd.Dir = g.repoDir
+
+	output, err := cmd.Output()
 	if err != nil {
-		return false, fmt.Errorf("failed to get remote HEAD: %w", err)
+		return nil, fmt.Errorf("failed to diff %s..%s: %w", from, to, err)
 	}
-	remote := strings.TrimSpace(string(remoteOutput))
 
-	return local != remote, nil
+	var files []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
 }
 
-//  pull latest changes from remote
-func (g *GitManager) Pull() error {
-	g.log.Info("Pulling latest changes from GitHub...")
-	
-	cmd := exec.Command("git", "pull", "origin", g.branch)
+//  check if the checked out commit differs from the one to deploy
+func (g *GitManager) CheckForUpdates(sha string) (bool, error) {
+	local, err := g.GetCurrentCommit()
+	if err != nil {
+		return false, fmt.Errorf("failed to get local HEAD: %w", err)
+	}
+
+	return local != sha, nil
+}
+
+// Checkout points the local branch at sha and checks it out
+func (g *GitManager) Checkout(sha string) error {
+	g.log.Infof("Checking out %s on %s...", sha[:7], g.branch)
+
+	cmd := exec.Command("git", "checkout", "-f", "-B", g.branch, sha)
 	cmd.Dir = g.repoDir
-	
+
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to pull from GitHub: %w\nOutput: %s", err, string(output))
+		return fmt.Errorf("failed to check out %s: %w\nOutput: %s", sha, err, string(output))
+	}
+
+	current, err := g.GetCurrentCommit()
+	if err != nil {
+		return err
+	}
+	if current != sha {
+		return fmt.Errorf("checked out %s but HEAD is %s", sha, current)
 	}
 
 	return nil
@@ -172,4 +255,62 @@ func (g *GitManager) GetCurrentCommit() (string, error) {
 	}
 
 	return strings.TrimSpace(string(output)), nil
-}
\ No newline at end of file
+}
+
+//  return a one line description of the checked out commit
+func (g *GitManager) DescribeHead() (string, error) {
+	cmd := exec.Command("git", "log", "-1", "--format=%h %s (%cr, %an)")
+	cmd.Dir = g.repoDir
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to describe HEAD: %w", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// AddWorktree checks the tip of origin/<branch> out into dir as a worktree of this repository, unless dir exists
+func (g *GitManager) AddWorktree(dir, branch string) (bool, error) {
+	if _, err := os.Stat(dir); err == nil {
+		return false, nil
+	}
+
+	g.log.Infof("Adding worktree for %s at %s...", branch, dir)
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return false, fmt.Errorf("failed to create parent directory: %w", err)
+	}
+
+	// Worktrees left behind by a directory that was deleted by hand would block the add
+	exec.Command("git", "-C", g.repoDir, "worktree", "prune").Run()
+
+	cmd := exec.Command("git", "worktree", "add", "--detach", dir, "origin/"+branch)
+	cmd.Dir = g.repoDir
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("failed to add worktree: %w\nOutput: %s", err, string(output))
+	}
+
+	return true, nil
+}
+
+// RemoveWorktree deletes a worktree added by AddWorktree together with its local branch
+func (g *GitManager) RemoveWorktree(dir, branch string) error {
+	g.log.Infof("Removing worktree %s...", dir)
+
+	cmd := exec.Command("git", "worktree", "remove", "--force", dir)
+	cmd.Dir = g.repoDir
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		// Not a worktree (any more), the directory still has to go
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove worktree: %w\nOutput: %s", err, string(output))
+		}
+		exec.Command("git", "-C", g.repoDir, "worktree", "prune").Run()
+	}
+
+	exec.Command("git", "-C", g.repoDir, "branch", "-D", branch).Run()
+	return nil
+}
@@ -16,6 +16,10 @@ type HealthChecker struct {
 	appName     string
 	projectType types.ProjectType
 	log         *logger.Logger
+
+	// url and timeout replace http://<domain> and the default client when set
+	url     string
+	timeout time.Duration
 }
 
 func New(domain string, port int, appName string, projectType types.ProjectType, log *logger.Logger) *HealthChecker {
@@ -28,8 +32,14 @@ func New(domain string, port int, appName string, projectType types.ProjectType,
 	}
 }
 
+// SetURL checks url instead of the domain, giving each request timeout to answer
+func (h *HealthChecker) SetURL(url string, timeout time.Duration) {
+	h.url = url
+	h.timeout = timeout
+}
+
 func (h *HealthChecker) CheckHTTP() error {
-	if h.domain == "" {
+	if h.domain == "" && h.url == "" {
 		h.log.Warning("No domain configured, skipping HTTP check")
 		return nil
 	}
@@ -37,11 +47,15 @@ func (h *HealthChecker) CheckHTTP() error {
 	h.log.Info("Performing HTTP health check...")
 
 	url := fmt.Sprintf("http://%s", h.domain)
+	if h.url != "" {
+		url = h.url
+	}
+	client := &http.Client{Timeout: h.timeout}
 	
 	// Retry logic
 	maxAttempts := 5
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		resp, err := http.Get(url)
+		resp, err := client.Get(url)
 		if err != nil {
 			if attempt < maxAttempts {
 				h.log.Infof("HTTP check attempt %d/%d failed, retrying in 2s...", attempt, maxAttempts)
@@ -0,0 +1,145 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// DefaultTimeout is how long a hook without a timeout may run
+const DefaultTimeout = 5 * time.Minute
+
+// Run runs the hooks of a stage one after another in dir with env added to the agent's environment.
+// A hook that fails or runs out of time stops the rest and is returned, unless it may continue on error
+func Run(stage types.HookStage, dir string, hooks []types.Hook, env []string, log *logger.Logger) error {
+	return RunContext(context.Background(), stage, dir, hooks, env, log)
+}
+
+// RunContext is Run with hooks that are killed when ctx is cancelled
+func RunContext(ctx context.Context, stage types.HookStage, dir string, hooks []types.Hook, env []string, log *logger.Logger) error {
+	for _, hook := range hooks {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s hooks cancelled: %w", stage, ctx.Err())
+		}
+
+		err := run(ctx, stage, dir, hook, env, log)
+		if err == nil {
+			continue
+		}
+
+		if hook.ContinueOnError {
+			log.Warningf("%v (continue_on_error is set)", err)
+			continue
+		}
+		return err
+	}
+
+	return nil
+}
+
+// run a single hook through the shell, killing everything it started when its time is up
+func run(parent context.Context, stage types.HookStage, dir string, hook types.Hook, env []string, log *logger.Logger) error {
+	timeout, err := ParseTimeout(hook.Timeout)
+	if err != nil {
+		return fmt.Errorf("%s hook %q: %w", stage, hook.Run, err)
+	}
+
+	log.Infof("Running %s hook: %s", stage, hook.Run)
+	startTime := time.Now()
+
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.Run)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	// The hook's own children are in its process group, a timeout must not leave them running
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err = cmd.Run()
+
+	for _, line := range strings.Split(strings.TrimRight(output.String(), "\n"), "\n") {
+		if line != "" {
+			log.Infof("  [%s] %s", stage, line)
+		}
+	}
+
+	if parent.Err() != nil {
+		return fmt.Errorf("%s hook %q cancelled: %w", stage, hook.Run, parent.Err())
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s hook %q timed out after %v", stage, hook.Run, timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("%s hook %q exited with code %d", stage, hook.Run, exitErr.ExitCode())
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook %q failed: %w", stage, hook.Run, err)
+	}
+
+	log.Successf("%s hook finished in %v", stage, time.Since(startTime).Round(time.Millisecond))
+	return nil
+}
+
+// ParseTimeout reads a hook timeout such as 90s or 5m, empty means DefaultTimeout
+func ParseTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return DefaultTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("timeout %q is not a positive duration such as 90s", value)
+	}
+	return timeout, nil
+}
+
+// Validate checks every hook of a config for commands and timeouts that can never run
+func Validate(hooks *types.Hooks) error {
+	if _, err := ParseTimeout(hooks.Timeout); err != nil {
+		return fmt.Errorf("hooks: %w", err)
+	}
+
+	for _, stage := range Stages {
+		for _, hook := range hooks.For(stage) {
+			if strings.TrimSpace(hook.Run) == "" {
+				return fmt.Errorf("hooks.%s: hook without a command", stage)
+			}
+			if _, err := ParseTimeout(hook.Timeout); err != nil {
+				return fmt.Errorf("hooks.%s: %q: %w", stage, hook.Run, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stages lists the hook stages in the order a deployment reaches them
+var Stages = []types.HookStage{
+	types.HookBeforeFetch,
+	types.HookAfterPull,
+	types.HookBeforeBuild,
+	types.HookAfterBuild,
+	types.HookBeforeSwitch,
+	types.HookAfterSwitch,
+	types.HookOnSuccess,
+	types.HookOnFailure,
+}
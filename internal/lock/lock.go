@@ -0,0 +1,231 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Policy decides what a deployment does when another one holds the repository lock
+type Policy string
+
+const (
+	// PolicyWait blocks until the running deployment finishes
+	PolicyWait Policy = "wait"
+	// PolicyFail gives up immediately
+	PolicyFail Policy = "fail"
+	// PolicySupersede waits, but only the newest waiting deployment runs
+	PolicySupersede Policy = "supersede"
+)
+
+var (
+	ErrLocked     = errors.New("another deployment of this repository is running")
+	ErrSuperseded = errors.New("superseded by a newer deployment")
+)
+
+// how often a waiting deployment tries the lock again
+var pollInterval = 2 * time.Second
+
+// ParsePolicy validates a policy name, an empty name means PolicyWait
+func ParsePolicy(name string) (Policy, error) {
+	switch Policy(name) {
+	case "":
+		return PolicyWait, nil
+	case PolicyWait, PolicyFail, PolicySupersede:
+		return Policy(name), nil
+	}
+	return "", fmt.Errorf("unknown lock policy %q (expected %s, %s or %s)", name, PolicyWait, PolicyFail, PolicySupersede)
+}
+
+// RepoLock is an exclusive flock on a repository, released by the kernel if the process dies
+type RepoLock struct {
+	file         *os.File
+	lockPath     string
+	pendingPath  string
+	deploymentID string
+}
+
+func New(stateDir, repoName, deploymentID string) *RepoLock {
+	lockDir := filepath.Join(stateDir, "locks")
+	return &RepoLock{
+		lockPath:     filepath.Join(lockDir, repoName+".lock"),
+		pendingPath:  filepath.Join(lockDir, repoName+".pending"),
+		deploymentID: deploymentID,
+	}
+}
+
+// Acquire takes the lock according to the policy, giving up after timeout when waiting
+func (l *RepoLock) Acquire(policy Policy, timeout time.Duration, onWait func(holder string)) error {
+	if err := os.MkdirAll(filepath.Dir(l.pendingPath), 0700); err != nil {
+		return fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	// The newest arrival is always the pending one, so any older waiter gives way to it
+	if policy == PolicySupersede {
+		err := l.withPendingLock(func() error {
+			return writeFileAtomic(l.pendingPath, l.deploymentID)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to register pending deployment: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(l.lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	locked, err := tryLock(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if !locked {
+		holder := readHolder(l.lockPath)
+
+		if policy == PolicyFail {
+			file.Close()
+			return fmt.Errorf("%w (%s)", ErrLocked, holder)
+		}
+
+		if onWait != nil {
+			onWait(holder)
+		}
+
+		if err := l.wait(file, policy, timeout, holder); err != nil {
+			file.Close()
+			l.clearPending()
+			return err
+		}
+	}
+
+	l.file = file
+	l.writeHolder()
+	return nil
+}
+
+// poll the lock until it is free, the timeout passes or a newer deployment supersedes this one
+func (l *RepoLock) wait(file *os.File, policy Policy, timeout time.Duration, holder string) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if policy == PolicySupersede && l.superseded() {
+			return ErrSuperseded
+		}
+
+		locked, err := tryLock(file)
+		if err != nil {
+			return err
+		}
+
+		if locked {
+			// A newer push may have registered between the last check and the lock
+			if policy == PolicySupersede && l.superseded() {
+				syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+				return ErrSuperseded
+			}
+			return nil
+		}
+
+		if timeout > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("%w: still held after %v (%s)", ErrLocked, timeout, holder)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// report whether another deployment registered itself as the pending one
+func (l *RepoLock) superseded() bool {
+	data, err := os.ReadFile(l.pendingPath)
+	if err != nil {
+		return false
+	}
+	pending := strings.TrimSpace(string(data))
+	return pending != "" && pending != l.deploymentID
+}
+
+// Release unlocks the repository. The pending request of this deployment is cleared with it, so
+// it cannot make the next deployment's waiters give way to a deployment that already ran
+func (l *RepoLock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+
+	l.clearPending()
+	l.file.Truncate(0)
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+
+	if err != nil {
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+	return nil
+}
+
+// remove the pending request while it is still this deployment's, a newer one is left in place
+func (l *RepoLock) clearPending() {
+	l.withPendingLock(func() error {
+		data, err := os.ReadFile(l.pendingPath)
+		if err != nil || strings.TrimSpace(string(data)) != l.deploymentID {
+			return nil
+		}
+		return os.Remove(l.pendingPath)
+	})
+}
+
+// run fn holding a lock on the pending file, so a newer request is not removed between the
+// check that the request is ours and its removal
+func (l *RepoLock) withPendingLock(fn func() error) error {
+	file, err := os.OpenFile(l.pendingPath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// record who holds the lock so waiting deployments can say what they wait for
+func (l *RepoLock) writeHolder() {
+	l.file.Truncate(0)
+	l.file.WriteAt([]byte(fmt.Sprintf("deployment %s (pid %d)\n", l.deploymentID, os.Getpid())), 0)
+}
+
+func readHolder(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+		return "holder unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// take the lock without blocking, reporting whether it was free
+func tryLock(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to lock: %w", err)
+}
+
+func writeFileAtomic(path, content string) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, []byte(content+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,193 @@
+package lock
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	pollInterval = 10 * time.Millisecond
+}
+
+// hold takes the lock of repo in the state directory for a deployment, failing the test otherwise
+func hold(t *testing.T, stateDir, deploymentID string, policy Policy) *RepoLock {
+	t.Helper()
+	l := New(stateDir, "app", deploymentID)
+	if err := l.Acquire(policy, time.Second, nil); err != nil {
+		t.Fatalf("%s could not take the lock: %v", deploymentID, err)
+	}
+	t.Cleanup(func() { l.Release() })
+	return l
+}
+
+func pending(t *testing.T, l *RepoLock) string {
+	t.Helper()
+	data, err := os.ReadFile(l.pendingPath)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestPolicyFail(t *testing.T) {
+	stateDir := t.TempDir()
+	hold(t, stateDir, "first", PolicyWait)
+
+	err := New(stateDir, "app", "second").Acquire(PolicyFail, time.Second, func(string) {
+		t.Error("a failing deployment waited")
+	})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("Acquire = %v, want %v", err, ErrLocked)
+	}
+	if !strings.Contains(err.Error(), "deployment first") {
+		t.Errorf("the error does not name the holder: %v", err)
+	}
+
+	// Another repository's lock is independent
+	other := New(stateDir, "api", "third")
+	if err := other.Acquire(PolicyFail, time.Second, nil); err != nil {
+		t.Errorf("the lock of another repository is held: %v", err)
+	}
+	other.Release()
+}
+
+func TestPolicyWait(t *testing.T) {
+	stateDir := t.TempDir()
+	first := hold(t, stateDir, "first", PolicyWait)
+
+	waitedFor := ""
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Release()
+		close(released)
+	}()
+
+	second := New(stateDir, "app", "second")
+	if err := second.Acquire(PolicyWait, 5*time.Second, func(holder string) { waitedFor = holder }); err != nil {
+		t.Fatalf("Acquire after the holder released = %v", err)
+	}
+	defer second.Release()
+	<-released
+
+	if !strings.Contains(waitedFor, "deployment first") {
+		t.Errorf("onWait got %q, want the holder", waitedFor)
+	}
+	if holder := readHolder(second.lockPath); !strings.Contains(holder, "deployment second") {
+		t.Errorf("the lock file names %q, want the new holder", holder)
+	}
+}
+
+func TestPolicyWaitTimeout(t *testing.T) {
+	stateDir := t.TempDir()
+	hold(t, stateDir, "first", PolicyWait)
+
+	start := time.Now()
+	err := New(stateDir, "app", "second").Acquire(PolicyWait, 50*time.Millisecond, nil)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("Acquire = %v, want %v", err, ErrLocked)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("gave up before the timeout")
+	}
+}
+
+func TestPolicySupersede(t *testing.T) {
+	stateDir := t.TempDir()
+	first := hold(t, stateDir, "first", PolicyWait)
+
+	older := make(chan error)
+	waiting := make(chan struct{})
+	go func() {
+		older <- New(stateDir, "app", "second").Acquire(PolicySupersede, 5*time.Second, func(string) { close(waiting) })
+	}()
+	<-waiting
+
+	newer := make(chan error)
+	newest := New(stateDir, "app", "third")
+	go func() {
+		newer <- newest.Acquire(PolicySupersede, 5*time.Second, nil)
+	}()
+
+	if err := <-older; !errors.Is(err, ErrSuperseded) {
+		t.Fatalf("the older waiter got %v, want %v", err, ErrSuperseded)
+	}
+
+	first.Release()
+	if err := <-newer; err != nil {
+		t.Fatalf("the newest waiter got %v", err)
+	}
+	defer newest.Release()
+
+	if holder := readHolder(newest.lockPath); !strings.Contains(holder, "deployment third") {
+		t.Errorf("the lock file names %q, want the newest deployment", holder)
+	}
+}
+
+func TestReleaseClearsPending(t *testing.T) {
+	stateDir := t.TempDir()
+
+	first := hold(t, stateDir, "first", PolicySupersede)
+	if got := pending(t, first); got != "first" {
+		t.Fatalf("pending = %q, want first", got)
+	}
+	first.Release()
+	if got := pending(t, first); got != "" {
+		t.Errorf("pending after release = %q, want none", got)
+	}
+}
+
+func TestReleaseKeepsNewerPending(t *testing.T) {
+	stateDir := t.TempDir()
+	first := hold(t, stateDir, "first", PolicySupersede)
+
+	// A newer deployment registers itself while the first one runs
+	if err := writeFileAtomic(first.pendingPath, "second"); err != nil {
+		t.Fatal(err)
+	}
+	first.Release()
+
+	if got := pending(t, first); got != "second" {
+		t.Errorf("pending after release = %q, want the newer deployment kept", got)
+	}
+}
+
+func TestTimedOutSupersedeClearsPending(t *testing.T) {
+	stateDir := t.TempDir()
+	hold(t, stateDir, "first", PolicyWait)
+
+	waiter := New(stateDir, "app", "second")
+	if err := waiter.Acquire(PolicySupersede, 30*time.Millisecond, nil); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Acquire = %v, want %v", err, ErrLocked)
+	}
+	if got := pending(t, waiter); got != "" {
+		t.Errorf("pending after the timeout = %q, want none", got)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		want Policy
+		err  bool
+	}{
+		{"", PolicyWait, false},
+		{"wait", PolicyWait, false},
+		{"fail", PolicyFail, false},
+		{"supersede", PolicySupersede, false},
+		{"queue", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePolicy(tt.name)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("ParsePolicy(%q) = %q, %v", tt.name, got, err)
+		}
+	}
+}
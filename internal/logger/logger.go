@@ -3,6 +3,7 @@ package logger
 import (
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Brayzonn/deploy-agent/pkg/types"
@@ -19,6 +20,10 @@ const (
 type Logger struct {
 	deploymentID string
 	logFile      *os.File
+	// prefix starts every message of a logger made by WithPrefix
+	prefix string
+	// mu is shared with the loggers made by WithPrefix so their lines never interleave
+	mu *sync.Mutex
 }
 
 
@@ -29,7 +34,7 @@ func New(deploymentID string, logPath string) (*Logger, error) {
 	}
 
 	// Create log file
-	logFileName := fmt.Sprintf("%s/deployment_%s.log", logPath, deploymentID)
+	logFileName := LogFilePath(logPath, deploymentID)
 	logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create log file: %w", err)
@@ -38,9 +43,31 @@ func New(deploymentID string, logPath string) (*Logger, error) {
 	return &Logger{
 		deploymentID: deploymentID,
 		logFile:      logFile,
+		mu:           &sync.Mutex{},
 	}, nil
 }
 
+// WithPrefix returns a logger that writes to the same console and file with prefix before
+// every message, for work that runs alongside other work. Only the original is closed
+func (l *Logger) WithPrefix(prefix string) *Logger {
+	prefixed := *l
+	prefixed.prefix = l.prefix + prefix
+	return &prefixed
+}
+
+// LogFilePath returns where the log of a deployment is written
+func LogFilePath(logPath, deploymentID string) string {
+	return fmt.Sprintf("%s/deployment_%s.log", logPath, deploymentID)
+}
+
+// FilePath returns the path of the log file, or "" for console-only loggers
+func (l *Logger) FilePath() string {
+	if l.logFile == nil {
+		return ""
+	}
+	return l.logFile.Name()
+}
+
 //  close the log file
 func (l *Logger) Close() error {
 	if l.logFile != nil {
@@ -52,7 +79,11 @@ func (l *Logger) Close() error {
 //  write a message with color to both stdout and log file
 func (l *Logger) log(color, level, message string) {
 	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	
+	message = l.prefix + message
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	fmt.Printf("%s[%s] [%s] %s%s\n", color, timestamp, level, message, ColorReset)
 	
 	if l.logFile != nil {
@@ -118,5 +149,6 @@ func DefaultLogger() *Logger {
 	return &Logger{
 		deploymentID: "default",
 		logFile:      nil,
+		mu:           &sync.Mutex{},
 	}
 }
\ No newline at end of file
@@ -17,6 +17,10 @@ type NginxManager struct {
 	projectType   types.ProjectType
 	port          int 
 	log           *logger.Logger
+
+	// apiPath and apiPort are set when a client's site also proxies a path to its server
+	apiPath string
+	apiPort int
 }
 
 func New(domain string, domainAliases []string, webRoot string, projectType types.ProjectType, port int, log *logger.Logger) *NginxManager {
@@ -30,6 +34,12 @@ func New(domain string, domainAliases []string, webRoot string, projectType type
 	}
 }
 
+// SetAPIProxy makes a client's site pass requests under path, such as /api, to the server on port
+func (n *NginxManager) SetAPIProxy(path string, port int) {
+	n.apiPath = path
+	n.apiPort = port
+}
+
 func (n *NginxManager) ConfigExists() bool {
 	configPath := fmt.Sprintf("/etc/nginx/sites-available/%s", n.domain)
 	_, err := os.Stat(configPath)
@@ -40,6 +50,7 @@ func (n *NginxManager) ConfigExists() bool {
 func (n *NginxManager) GenerateConfig() error {
 	if n.ConfigExists() {
 		n.log.Info("Nginx config already exists, skipping generation")
+		n.checkAPIProxy()
 		return nil
 	}
 
@@ -69,6 +80,54 @@ func (n *NginxManager) GenerateConfig() error {
 	return nil
 }
 
+// warn when a site written before api_path was set does not proxy it, the agent never rewrites a site
+func (n *NginxManager) checkAPIProxy() {
+	if n.apiPath == "" {
+		return
+	}
+
+	data, err := os.ReadFile(fmt.Sprintf("/etc/nginx/sites-available/%s", n.domain))
+	if err != nil {
+		return
+	}
+
+	if !strings.Contains(string(data), n.apiLocation()) {
+		n.log.Warningf("Nginx config of %s does not proxy %s to the server, remove it so it is generated again", n.domain, n.apiPath)
+	}
+}
+
+// rewrites "root oldRoot;" in an existing config, for sites that were served before the current web root existed
+func (n *NginxManager) MigrateRoot(oldRoot string) error {
+	configPath := fmt.Sprintf("/etc/nginx/sites-available/%s", n.domain)
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read nginx config: %w", err)
+	}
+
+	oldLine := fmt.Sprintf("root %s;", oldRoot)
+	if !strings.Contains(string(data), oldLine) {
+		return nil
+	}
+
+	n.log.Infof("Pointing nginx root at %s...", n.webRoot)
+	config := strings.ReplaceAll(string(data), oldLine, fmt.Sprintf("root %s;", n.webRoot))
+
+	cmd := exec.Command("sudo", "tee", configPath)
+	cmd.Stdin = strings.NewReader(config)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to update nginx config: %w\nOutput: %s", err, string(output))
+	}
+
+	n.log.Successf("Nginx config updated: %s", configPath)
+	return nil
+}
+
 // EnableSite enables the nginx site
 func (n *NginxManager) EnableSite() error {
 	sourcePath := fmt.Sprintf("/etc/nginx/sites-available/%s", n.domain)
@@ -117,6 +176,28 @@ func (n *NginxManager) Reload() error {
 	return nil
 }
 
+// Remove disables and deletes the site's config, then reloads nginx
+func (n *NginxManager) Remove() error {
+	if !n.ConfigExists() {
+		return nil
+	}
+
+	n.log.Infof("Removing nginx site %s...", n.domain)
+
+	cmd := exec.Command("sudo", "rm", "-f",
+		fmt.Sprintf("/etc/nginx/sites-enabled/%s", n.domain),
+		fmt.Sprintf("/etc/nginx/sites-available/%s", n.domain))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove nginx config: %w\nOutput: %s", err, string(output))
+	}
+
+	if err := n.TestConfig(); err != nil {
+		return err
+	}
+
+	return n.Reload()
+}
+
 // Setup 
 func (n *NginxManager) Setup() error {
 	if err := n.GenerateConfig(); err != nil {
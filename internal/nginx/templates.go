@@ -16,7 +16,7 @@ func (n *NginxManager) generateClientConfig() string {
     server_name %s;
     root %s;
     index index.html;
-
+%s
     location / {
         try_files $uri $uri/ /index.html;
     }
@@ -36,7 +36,34 @@ func (n *NginxManager) generateClientConfig() string {
         expires 1y;
         add_header Cache-Control "public, immutable";
     }
-}`, serverNames, n.webRoot)
+}`, serverNames, n.webRoot, n.generateAPIProxy())
+}
+
+// the location line of the API proxy, also how an existing config is recognised as having one
+func (n *NginxManager) apiLocation() string {
+	return fmt.Sprintf("location ^~ %s/ {", n.apiPath)
+}
+
+//  create the location block of a client's site that proxies api_path to the server
+func (n *NginxManager) generateAPIProxy() string {
+	if n.apiPath == "" {
+		return ""
+	}
+
+	// ^~ keeps the static asset location below from matching API paths that end in .js or .css
+	return fmt.Sprintf(`
+    %s
+        proxy_pass http://localhost:%d;
+        proxy_http_version 1.1;
+        proxy_set_header Upgrade $http_upgrade;
+        proxy_set_header Connection 'upgrade';
+        proxy_set_header Host $host;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Proto $scheme;
+        proxy_cache_bypass $http_upgrade;
+    }
+`, n.apiLocation(), n.apiPort)
 }
 
 //  create nginx config for API reverse proxy
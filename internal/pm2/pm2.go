@@ -3,6 +3,7 @@ package pm2
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 	"time"
@@ -12,15 +13,17 @@ import (
 
 
 type PM2Manager struct {
-	appName string
-	workDir string
-	log     *logger.Logger
+	appName     string
+	workDir     string
+	interpreter string
+	log         *logger.Logger
 }
 
 type PM2Process struct {
 	Name   string `json:"name"`
 	PM2Env struct {
-		Status string `json:"status"`
+		Status          string `json:"status"`
+		ExecInterpreter string `json:"exec_interpreter"`
 	} `json:"pm2_env"`
 }
 
@@ -32,6 +35,19 @@ func New(appName, workDir string, log *logger.Logger) *PM2Manager {
 	}
 }
 
+// SetInterpreter starts the app with a node binary other than the one PM2 runs on
+func (p *PM2Manager) SetInterpreter(interpreter string) {
+	p.interpreter = interpreter
+}
+
+// the flags that start the app with its interpreter
+func (p *PM2Manager) interpreterArgs() []string {
+	if p.interpreter == "" {
+		return nil
+	}
+	return []string{"--interpreter", p.interpreter}
+}
+
 func IsInstalled() bool {
 	cmd := exec.Command("pm2", "--version")
 	return cmd.Run() == nil
@@ -81,11 +97,33 @@ func (p *PM2Manager) GetStatus() (string, error) {
 	return "", fmt.Errorf("app not found: %s", p.appName)
 }
 
+// GetInterpreter returns the interpreter the running app was started with
+func (p *PM2Manager) GetInterpreter() (string, error) {
+	cmd := exec.Command("pm2", "jlist")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get PM2 list: %w", err)
+	}
+
+	var processes []PM2Process
+	if err := json.Unmarshal(output, &processes); err != nil {
+		return "", fmt.Errorf("failed to parse PM2 list: %w", err)
+	}
+
+	for _, proc := range processes {
+		if proc.Name == p.appName {
+			return proc.PM2Env.ExecInterpreter, nil
+		}
+	}
+
+	return "", fmt.Errorf("app not found: %s", p.appName)
+}
+
 //  starts the PM2 app using ecosystem file
 func (p *PM2Manager) Start(ecosystemFile string) error {
 	p.log.Infof("Starting PM2 app '%s' with ecosystem file...", p.appName)
 	
-	cmd := exec.Command("pm2", "start", ecosystemFile)
+	cmd := exec.Command("pm2", append([]string{"start", ecosystemFile}, p.interpreterArgs()...)...)
 	cmd.Dir = p.workDir
 	
 	output, err := cmd.CombinedOutput()
@@ -96,6 +134,26 @@ func (p *PM2Manager) Start(ecosystemFile string) error {
 	return nil
 }
 
+// StartScript starts a script as the PM2 app with extra environment variables, replacing an app of the same name
+func (p *PM2Manager) StartScript(script string, env []string) error {
+	if exists, err := p.AppExists(); err == nil && exists {
+		p.Delete()
+	}
+
+	p.log.Infof("Starting PM2 app '%s' from %s...", p.appName, script)
+
+	cmd := exec.Command("pm2", append([]string{"start", script, "--name", p.appName}, p.interpreterArgs()...)...)
+	cmd.Dir = p.workDir
+	cmd.Env = append(os.Environ(), env...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to start PM2 app: %w\nOutput: %s", err, string(output))
+	}
+
+	return nil
+}
+
 //  restarts the PM2 app
 func (p *PM2Manager) Restart(ecosystemFile string) error {
 	p.log.Infof("Restarting PM2 app '%s'...", p.appName)
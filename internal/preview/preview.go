@@ -0,0 +1,409 @@
+package preview
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/internal/build"
+	"github.com/Brayzonn/deploy-agent/internal/git"
+	"github.com/Brayzonn/deploy-agent/internal/lock"
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/internal/nginx"
+	"github.com/Brayzonn/deploy-agent/internal/pm2"
+	"github.com/Brayzonn/deploy-agent/internal/ssl"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// Record is a preview environment with everything needed to tear it down, even after its repo config changed
+type Record struct {
+	Repo        string            `json:"repo"`
+	Branch      string            `json:"branch"`
+	Slug        string            `json:"slug"`
+	Target      string            `json:"target"`
+	ProjectType types.ProjectType `json:"project_type"`
+	Domains     []string          `json:"domains"`
+	Port        int               `json:"port,omitempty"`
+	Dir         string            `json:"dir"`
+	BaseDir     string            `json:"base_dir"`
+	BaseTarget  string            `json:"base_target,omitempty"`
+	WebRoot     string            `json:"web_root,omitempty"`
+	PM2AppName  string            `json:"pm2_app_name,omitempty"`
+	Project     string            `json:"compose_project,omitempty"`
+	ComposeDir  string            `json:"compose_dir,omitempty"`
+	ComposeFile string            `json:"compose_file,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	DeployedAt  *time.Time        `json:"deployed_at,omitempty"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+
+	// ServerDomain is the site of a fullstack preview's server, whose Domains are its client's site.
+	// It is empty when the client's site proxies the server
+	ServerDomain      string            `json:"server_domain,omitempty"`
+	ServerProjectType types.ProjectType `json:"server_project_type,omitempty"`
+}
+
+// Store keeps a JSON file per preview under the state directory
+type Store struct {
+	stateDir string
+	dir      string
+}
+
+func NewStore(stateDir string) *Store {
+	return &Store{
+		stateDir: stateDir,
+		dir:      filepath.Join(stateDir, "previews"),
+	}
+}
+
+func (s *Store) path(repo, slug string) string {
+	return filepath.Join(s.dir, repo, slug+".json")
+}
+
+// Allocate returns the record of a config's preview, creating it with a free port on the first deployment
+func (s *Store) Allocate(config *types.RepoConfig) (*Record, error) {
+	preview := config.Preview
+	if preview == nil {
+		return nil, fmt.Errorf("%s is not a preview", config.Target())
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	record, err := s.Get(config.Name, preview.Slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if record == nil {
+		now := time.Now()
+		record = &Record{
+			Repo:      config.Name,
+			Branch:    preview.Branch,
+			Slug:      preview.Slug,
+			CreatedAt: now,
+			ExpiresAt: now.Add(preview.TTL),
+		}
+	}
+
+	record.Target = config.Target()
+	record.ProjectType = config.ProjectType
+	record.Domains = []string{config.Domain}
+	record.ServerDomain = ""
+	record.ServerProjectType = ""
+	record.Dir = config.RepoDir
+	record.BaseDir = preview.BaseDir
+	record.BaseTarget = preview.BaseTarget
+	record.WebRoot = ""
+	record.PM2AppName = ""
+	record.Project = ""
+
+	if config.ProjectType == types.ProjectTypeClient || config.FullStack {
+		record.WebRoot = config.WebRoot
+	}
+
+	// Only servers need a port, static previews are served from their web root
+	if config.ProjectType != types.ProjectTypeClient || config.FullStack || config.UseDocker {
+		if record.Port == 0 {
+			if record.Port, err = s.freePort(preview.PortMin, preview.PortMax); err != nil {
+				return nil, err
+			}
+		}
+
+		if config.UseDocker {
+			record.Project = preview.Project
+			record.ComposeDir = config.RepoDir
+			if config.ServerDir != "" && config.ServerDir != "." {
+				record.ComposeDir = filepath.Join(config.RepoDir, config.ServerDir)
+			}
+			record.ComposeFile = config.DockerComposeFile
+		} else {
+			record.PM2AppName = config.PM2AppName
+		}
+
+		if config.FullStack {
+			record.ProjectType = types.ProjectTypeClient
+			if server := config.FullstackServer(); server.Domain != "" {
+				record.ServerDomain = server.Domain
+				record.ServerProjectType = config.ProjectType
+			}
+		}
+	}
+
+	if err := s.save(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Deployed pushes a preview's expiry back by its TTL after a deployment
+func (s *Store) Deployed(record *Record, ttl time.Duration) error {
+	now := time.Now()
+	record.DeployedAt = &now
+	record.ExpiresAt = now.Add(ttl)
+	return s.save(record)
+}
+
+// Get returns the record of a preview, nil when the branch has none
+func (s *Store) Get(repo, slug string) (*Record, error) {
+	data, err := os.ReadFile(s.path(repo, slug))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read preview record: %w", err)
+	}
+
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse preview record %s: %w", slug, err)
+	}
+
+	return &record, nil
+}
+
+// List returns the previews of a repository, or of every repository when repo is empty, oldest first
+func (s *Store) List(repo string) ([]*Record, error) {
+	pattern := filepath.Join(s.dir, "*", "*.json")
+	if repo != "" {
+		pattern = filepath.Join(s.dir, repo, "*.json")
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list previews: %w", err)
+	}
+
+	records := make([]*Record, 0, len(matches))
+	for _, path := range matches {
+		record, err := s.Get(filepath.Base(filepath.Dir(path)), strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil || record == nil {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+
+	return records, nil
+}
+
+// Expired returns the previews whose TTL ran out
+func (s *Store) Expired(now time.Time) ([]*Record, error) {
+	records, err := s.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []*Record
+	for _, record := range records {
+		if now.After(record.ExpiresAt) {
+			expired = append(expired, record)
+		}
+	}
+	return expired, nil
+}
+
+// Destroy tears a preview down: nginx sites, certificates, the PM2 app or compose project, its files
+// and worktree. It carries on past failures so a half removed preview can be destroyed again
+func (s *Store) Destroy(record *Record, log *logger.Logger) error {
+	return s.destroy(record, false, log)
+}
+
+// DestroyExpired destroys a preview returned by Expired, unless it was deployed again while
+// waiting for that deployment to finish
+func (s *Store) DestroyExpired(record *Record, log *logger.Logger) error {
+	return s.destroy(record, true, log)
+}
+
+func (s *Store) destroy(record *Record, onlyExpired bool, log *logger.Logger) error {
+	// Never pull a preview out from under its own deployment
+	previewLock := lock.New(s.stateDir, record.Target, fmt.Sprintf("destroy_%d", os.Getpid()))
+	if err := previewLock.Acquire(lock.PolicyWait, 10*time.Minute, func(holder string) {
+		log.Infof("Waiting for the running deployment of %s (%s)...", record.Target, holder)
+	}); err != nil {
+		return err
+	}
+	defer previewLock.Release()
+
+	// The deployment waited for may have moved the expiry, or another teardown removed the preview
+	current, err := s.Get(record.Repo, record.Slug)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		log.Infof("Preview of %s@%s is already destroyed", record.Repo, record.Branch)
+		return nil
+	}
+	if onlyExpired && time.Now().Before(current.ExpiresAt) {
+		log.Infof("Preview of %s@%s was deployed again, keeping it until %s", record.Repo, record.Branch,
+			current.ExpiresAt.Format("2006-01-02 15:04:05"))
+		return nil
+	}
+	record = current
+
+	log.Infof("Destroying preview of %s@%s...", record.Repo, record.Branch)
+
+	var errs []error
+	removeSite := func(domain string, projectType types.ProjectType) {
+		if err := nginx.New(domain, nil, "", projectType, record.Port, log).Remove(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := ssl.New(domain, nil, "", log).DeleteCertificate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, domain := range record.Domains {
+		removeSite(domain, record.ProjectType)
+	}
+	if record.ServerDomain != "" {
+		removeSite(record.ServerDomain, record.ServerProjectType)
+	}
+
+	if record.Project != "" {
+		dockerBuilder := build.NewDockerBuilder(record.ComposeDir, record.ComposeFile, "", log)
+		dockerBuilder.SetProject(record.Project, nil)
+		if err := dockerBuilder.Remove(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if record.PM2AppName != "" {
+		pm2Manager := pm2.New(record.PM2AppName, "", log)
+		if exists, err := pm2Manager.AppExists(); err == nil && exists {
+			if err := pm2Manager.Delete(); err != nil {
+				errs = append(errs, err)
+			}
+			pm2Manager.Save()
+		}
+	}
+
+	if record.WebRoot != "" {
+		if err := os.RemoveAll(record.WebRoot); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove web root: %w", err))
+		}
+	}
+
+	if err := s.removeWorktree(record, log); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := build.NewInstallCache(s.stateDir, record.Target).Remove(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("preview of %s@%s was only partly destroyed: %w", record.Repo, record.Branch, err)
+	}
+
+	if err := os.Remove(s.path(record.Repo, record.Slug)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove preview record: %w", err)
+	}
+
+	log.Successf("Preview of %s@%s destroyed", record.Repo, record.Branch)
+	return nil
+}
+
+// remove the preview's worktree while holding the lock of the checkout it belongs to, whose
+// deployment must not run git in it at the same time
+func (s *Store) removeWorktree(record *Record, log *logger.Logger) error {
+	// Records written before base_target was kept belong to a repository without environments
+	baseTarget := record.BaseTarget
+	if baseTarget == "" {
+		baseTarget = record.Repo
+	}
+
+	baseLock := lock.New(s.stateDir, baseTarget, fmt.Sprintf("destroy_%d", os.Getpid()))
+	if err := baseLock.Acquire(lock.PolicyWait, 10*time.Minute, func(holder string) {
+		log.Infof("Waiting for the deployment of %s using the checkout (%s)...", baseTarget, holder)
+	}); err != nil {
+		return err
+	}
+	defer baseLock.Release()
+
+	return git.New(record.BaseDir, "", log).RemoveWorktree(record.Dir, record.Branch)
+}
+
+// pick the lowest port in the range that no other preview holds and nothing listens on
+func (s *Store) freePort(min, max int) (int, error) {
+	records, err := s.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	taken := make(map[int]bool, len(records))
+	for _, record := range records {
+		taken[record.Port] = true
+	}
+
+	for port := min; port <= max; port++ {
+		if taken[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			continue
+		}
+		listener.Close()
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("no free preview port between %d and %d", min, max)
+}
+
+// write the record atomically so a crash never leaves a half written file
+func (s *Store) save(record *Record) error {
+	path := s.path(record.Repo, record.Slug)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create preview directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode preview record: %w", err)
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write preview record: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write preview record: %w", err)
+	}
+
+	return nil
+}
+
+// hold the store lock so two previews are never given the same port
+func (s *Store) lock() (func(), error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create preview directory: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.dir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open preview lock: %w", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock previews: %w", err)
+	}
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
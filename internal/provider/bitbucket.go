@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// Bitbucket Cloud signs webhooks with X-Hub-Signature and can push several branches in one event
+type Bitbucket struct{}
+
+// bitbucketPush is the part of a Bitbucket push payload the agent needs
+type bitbucketPush struct {
+	Actor struct {
+		Nickname    string `json:"nickname"`
+		DisplayName string `json:"display_name"`
+	} `json:"actor"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Push struct {
+		Changes []struct {
+			// New is null when a branch was deleted, Old is null when it was created
+			New *bitbucketRef `json:"new"`
+			Old *bitbucketRef `json:"old"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+// bitbucketRef is the state of a branch or tag before or after a push
+type bitbucketRef struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+func (Bitbucket) Name() string        { return "bitbucket" }
+func (Bitbucket) DefaultHost() string { return "bitbucket.org" }
+
+func (Bitbucket) Event(header http.Header) string {
+	switch event := header.Get("X-Event-Key"); event {
+	case "repo:push":
+		return EventPush
+	case "diagnostics:ping":
+		return EventPing
+	default:
+		return event
+	}
+}
+
+func (Bitbucket) Verify(secret string, header http.Header, body []byte) bool {
+	signature, ok := strings.CutPrefix(header.Get("X-Hub-Signature"), "sha256=")
+	return ok && validHMAC(secret, body, signature)
+}
+
+func (Bitbucket) ParsePush(body []byte) ([]types.DeploymentRequest, error) {
+	var event bitbucketPush
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid push payload: %w", err)
+	}
+
+	// The repository name in the payload is the display name, the slug is only in full_name
+	owner, name := splitFullName(event.Repository.FullName)
+	if owner == "" || name == "" {
+		return nil, fmt.Errorf("push payload has no repository")
+	}
+
+	pusher := event.Actor.Nickname
+	if pusher == "" {
+		pusher = event.Actor.DisplayName
+	}
+
+	var requests []types.DeploymentRequest
+	for _, change := range event.Push.Changes {
+		ref, deleted := change.New, false
+		if ref == nil {
+			ref, deleted = change.Old, true
+		}
+		if ref == nil || ref.Type != "branch" {
+			continue
+		}
+
+		request := types.DeploymentRequest{
+			RepoName:     name,
+			RepoOwner:    owner,
+			RepoFullName: event.Repository.FullName,
+			Branch:       ref.Name,
+			Commit:       ref.Target.Hash,
+			Pusher:       pusher,
+			Provider:     "bitbucket",
+			Deleted:      deleted,
+		}
+		if deleted {
+			request.Commit = ""
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, nil
+}
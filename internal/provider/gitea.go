@@ -0,0 +1,78 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// Gitea signs webhooks with a bare hex HMAC in X-Gitea-Signature, it has no default host
+type Gitea struct{}
+
+// giteaPush is the part of a Gitea push payload the agent needs
+type giteaPush struct {
+	Ref    string `json:"ref"`
+	After  string `json:"after"`
+	Pusher struct {
+		Login    string `json:"login"`
+		Username string `json:"username"`
+	} `json:"pusher"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		Owner    struct {
+			Login    string `json:"login"`
+			Username string `json:"username"`
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+func (Gitea) Name() string        { return "gitea" }
+func (Gitea) DefaultHost() string { return "" }
+
+func (Gitea) Event(header http.Header) string {
+	return header.Get("X-Gitea-Event")
+}
+
+func (Gitea) Verify(secret string, header http.Header, body []byte) bool {
+	return validHMAC(secret, body, header.Get("X-Gitea-Signature"))
+}
+
+func (Gitea) ParsePush(body []byte) ([]types.DeploymentRequest, error) {
+	var event giteaPush
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid push payload: %w", err)
+	}
+
+	branch, isBranch := branchFromRef(event.Ref)
+	if !isBranch {
+		return nil, nil
+	}
+
+	owner := event.Repository.Owner.Login
+	if owner == "" {
+		owner = event.Repository.Owner.Username
+	}
+
+	if event.Repository.Name == "" || owner == "" {
+		return nil, fmt.Errorf("push payload has no repository")
+	}
+
+	pusher := event.Pusher.Login
+	if pusher == "" {
+		pusher = event.Pusher.Username
+	}
+
+	return []types.DeploymentRequest{{
+		RepoName:     event.Repository.Name,
+		RepoOwner:    owner,
+		RepoFullName: event.Repository.FullName,
+		Branch:       branch,
+		Commit:       event.After,
+		Pusher:       pusher,
+		Provider:     "gitea",
+		Deleted:      event.After == zeroSHA,
+	}}, nil
+}
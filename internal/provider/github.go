@@ -0,0 +1,75 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// GitHub signs webhooks with X-Hub-Signature-256
+type GitHub struct{}
+
+// githubPush is the part of a GitHub push payload the agent needs
+type githubPush struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+	Pusher  struct {
+		Name string `json:"name"`
+	} `json:"pusher"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		Owner    struct {
+			Login string `json:"login"`
+			Name  string `json:"name"`
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+func (GitHub) Name() string        { return "github" }
+func (GitHub) DefaultHost() string { return "github.com" }
+
+func (GitHub) Event(header http.Header) string {
+	return header.Get("X-GitHub-Event")
+}
+
+func (GitHub) Verify(secret string, header http.Header, body []byte) bool {
+	signature, ok := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+	return ok && validHMAC(secret, body, signature)
+}
+
+func (GitHub) ParsePush(body []byte) ([]types.DeploymentRequest, error) {
+	var event githubPush
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid push payload: %w", err)
+	}
+
+	branch, isBranch := branchFromRef(event.Ref)
+	if !isBranch {
+		return nil, nil
+	}
+
+	owner := event.Repository.Owner.Login
+	if owner == "" {
+		owner = event.Repository.Owner.Name
+	}
+
+	if event.Repository.Name == "" || owner == "" {
+		return nil, fmt.Errorf("push payload has no repository")
+	}
+
+	return []types.DeploymentRequest{{
+		RepoName:     event.Repository.Name,
+		RepoOwner:    owner,
+		RepoFullName: event.Repository.FullName,
+		Branch:       branch,
+		Commit:       event.After,
+		Pusher:       event.Pusher.Name,
+		Provider:     "github",
+		Deleted:      event.Deleted,
+	}}, nil
+}
@@ -0,0 +1,69 @@
+package provider
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// GitLab sends the webhook secret as a plain token in X-Gitlab-Token
+type GitLab struct{}
+
+// gitlabPush is the part of a GitLab push payload the agent needs
+type gitlabPush struct {
+	Ref          string `json:"ref"`
+	After        string `json:"after"`
+	UserUsername string `json:"user_username"`
+	Project      struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+}
+
+func (GitLab) Name() string        { return "gitlab" }
+func (GitLab) DefaultHost() string { return "gitlab.com" }
+
+func (GitLab) Event(header http.Header) string {
+	switch event := header.Get("X-Gitlab-Event"); event {
+	case "Push Hook":
+		return EventPush
+	default:
+		return event
+	}
+}
+
+func (GitLab) Verify(secret string, header http.Header, body []byte) bool {
+	token := header.Get("X-Gitlab-Token")
+	return secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func (GitLab) ParsePush(body []byte) ([]types.DeploymentRequest, error) {
+	var event gitlabPush
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid push payload: %w", err)
+	}
+
+	branch, isBranch := branchFromRef(event.Ref)
+	if !isBranch {
+		return nil, nil
+	}
+
+	// Projects can live in nested groups, the owner is everything before the project path
+	owner, name := splitFullName(event.Project.PathWithNamespace)
+	if owner == "" || name == "" {
+		return nil, fmt.Errorf("push payload has no project")
+	}
+
+	return []types.DeploymentRequest{{
+		RepoName:     name,
+		RepoOwner:    owner,
+		RepoFullName: event.Project.PathWithNamespace,
+		Branch:       branch,
+		Commit:       event.After,
+		Pusher:       event.UserUsername,
+		Provider:     "gitlab",
+		Deleted:      event.After == zeroSHA,
+	}}, nil
+}
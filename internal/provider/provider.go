@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// Event kinds every provider's webhook event header is mapped to
+const (
+	EventPush = "push"
+	EventPing = "ping"
+)
+
+// zeroSHA is the "after" commit of a push that deleted a branch
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// Provider knows the webhook format of a git host
+type Provider interface {
+	// Name is the value of provider in the repo config
+	Name() string
+	// DefaultHost is the host repositories are cloned from when git_host is not set
+	DefaultHost() string
+	// Event returns EventPush, EventPing or the provider's own name for any other event
+	Event(header http.Header) string
+	// Verify checks the webhook's signature or token against the secret
+	Verify(secret string, header http.Header, body []byte) bool
+	// ParsePush returns a request per pushed branch, deleted branches come back with Deleted set and tags are left out
+	ParsePush(body []byte) ([]types.DeploymentRequest, error)
+}
+
+var providers = []Provider{GitHub{}, GitLab{}, Gitea{}, Bitbucket{}}
+
+// Default is the provider of repositories without a provider in their config
+const Default = "github"
+
+// Get returns a provider by name, an empty name means Default
+func Get(name string) (Provider, error) {
+	if name == "" {
+		name = Default
+	}
+
+	for _, p := range providers {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown provider %q (expected %s)", name, strings.Join(Names(), ", "))
+}
+
+// Names lists the supported providers
+func Names() []string {
+	names := make([]string, len(providers))
+	for i, p := range providers {
+		names[i] = p.Name()
+	}
+	return names
+}
+
+// CloneURL builds the URL a repository is cloned from: clone_url when set, otherwise SSH or HTTPS on git_host
+func CloneURL(config *types.RepoConfig, repoFullName string) (string, error) {
+	if config.CloneURL != "" {
+		return config.CloneURL, nil
+	}
+
+	p, err := Get(config.Provider)
+	if err != nil {
+		return "", err
+	}
+
+	host := config.GitHost
+	if host == "" {
+		host = p.DefaultHost()
+	}
+	if host == "" {
+		return "", fmt.Errorf("git_host or clone_url is required for provider %s", p.Name())
+	}
+
+	switch config.CloneProtocol {
+	case "", "ssh":
+		return fmt.Sprintf("git@%s:%s.git", host, repoFullName), nil
+	case "https":
+		return fmt.Sprintf("https://%s/%s.git", host, repoFullName), nil
+	}
+
+	return "", fmt.Errorf("unknown clone_protocol %q (expected ssh or https)", config.CloneProtocol)
+}
+
+// check a hex HMAC-SHA256 of the body keyed with the secret
+func validHMAC(secret string, body []byte, signature string) bool {
+	if secret == "" {
+		return false
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// split a "refs/heads/<branch>" ref, ok is false for tags and other refs
+func branchFromRef(ref string) (string, bool) {
+	return strings.CutPrefix(ref, "refs/heads/")
+}
+
+// split "group/subgroup/repo" into its owner and repository name
+func splitFullName(fullName string) (owner, name string) {
+	index := strings.LastIndex(fullName, "/")
+	if index < 0 {
+		return "", fullName
+	}
+	return fullName[:index], fullName[index+1:]
+}
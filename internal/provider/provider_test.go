@@ -0,0 +1,151 @@
+package provider
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerify(t *testing.T) {
+	const secret = "s3cret"
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	valid := sign(secret, body)
+	wrong := sign("other", body)
+
+	tests := []struct {
+		name     string
+		provider Provider
+		secret   string
+		header   string
+		value    string
+		want     bool
+	}{
+		{"github valid", GitHub{}, secret, "X-Hub-Signature-256", "sha256=" + valid, true},
+		{"github uppercase hex", GitHub{}, secret, "X-Hub-Signature-256", "sha256=" + strings.ToUpper(valid), true},
+		{"github wrong signature", GitHub{}, secret, "X-Hub-Signature-256", "sha256=" + wrong, false},
+		{"github missing prefix", GitHub{}, secret, "X-Hub-Signature-256", valid, false},
+		{"github sha1 prefix", GitHub{}, secret, "X-Hub-Signature-256", "sha1=" + valid, false},
+		{"github non-hex", GitHub{}, secret, "X-Hub-Signature-256", "sha256=" + strings.Repeat("zz", 32), false},
+		{"github truncated", GitHub{}, secret, "X-Hub-Signature-256", "sha256=" + valid[:32], false},
+		{"github no header", GitHub{}, secret, "X-Other", "sha256=" + valid, false},
+		{"github empty secret", GitHub{}, "", "X-Hub-Signature-256", "sha256=" + sign("", body), false},
+
+		{"bitbucket valid", Bitbucket{}, secret, "X-Hub-Signature", "sha256=" + valid, true},
+		{"bitbucket wrong signature", Bitbucket{}, secret, "X-Hub-Signature", "sha256=" + wrong, false},
+		{"bitbucket missing prefix", Bitbucket{}, secret, "X-Hub-Signature", valid, false},
+		{"bitbucket non-hex", Bitbucket{}, secret, "X-Hub-Signature", "sha256=not-hex", false},
+		{"bitbucket empty secret", Bitbucket{}, "", "X-Hub-Signature", "sha256=" + sign("", body), false},
+
+		{"gitea valid", Gitea{}, secret, "X-Gitea-Signature", valid, true},
+		{"gitea wrong signature", Gitea{}, secret, "X-Gitea-Signature", wrong, false},
+		{"gitea prefixed", Gitea{}, secret, "X-Gitea-Signature", "sha256=" + valid, false},
+		{"gitea non-hex", Gitea{}, secret, "X-Gitea-Signature", "not-hex", false},
+		{"gitea empty secret", Gitea{}, "", "X-Gitea-Signature", sign("", body), false},
+
+		{"gitlab token", GitLab{}, secret, "X-Gitlab-Token", secret, true},
+		{"gitlab token mismatch", GitLab{}, secret, "X-Gitlab-Token", "s3cre", false},
+		{"gitlab signature instead of token", GitLab{}, secret, "X-Gitlab-Token", valid, false},
+		{"gitlab no token", GitLab{}, secret, "X-Other", secret, false},
+		{"gitlab empty secret", GitLab{}, "", "X-Gitlab-Token", "", false},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set(tt.header, tt.value)
+		if got := tt.provider.Verify(tt.secret, header, body); got != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyRejectsChangedBody(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Hub-Signature-256", "sha256="+sign("s3cret", []byte(`{"ref":"refs/heads/main"}`)))
+
+	if (GitHub{}).Verify("s3cret", header, []byte(`{"ref":"refs/heads/prod"}`)) {
+		t.Error("a signature verified a different body")
+	}
+}
+
+func TestBitbucketParsePush(t *testing.T) {
+	body := []byte(`{
+		"actor": {"nickname": "jdoe", "display_name": "Jane Doe"},
+		"repository": {"name": "My App", "full_name": "team/my-app"},
+		"push": {"changes": [
+			{"new": {"type": "branch", "name": "main", "target": {"hash": "aaa111"}},
+			 "old": {"type": "branch", "name": "main", "target": {"hash": "000aaa"}}},
+			{"new": {"type": "branch", "name": "feature/login", "target": {"hash": "bbb222"}}, "old": null},
+			{"new": null, "old": {"type": "branch", "name": "old-feature", "target": {"hash": "ccc333"}}},
+			{"new": {"type": "tag", "name": "v1.2.0", "target": {"hash": "aaa111"}}, "old": null},
+			{"new": null, "old": {"type": "tag", "name": "v1.1.0", "target": {"hash": "ddd444"}}},
+			{"new": null, "old": null}
+		]}
+	}`)
+
+	requests, err := Bitbucket{}.ParsePush(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(branch, commit string, deleted bool) types.DeploymentRequest {
+		return types.DeploymentRequest{
+			RepoName:     "my-app",
+			RepoOwner:    "team",
+			RepoFullName: "team/my-app",
+			Branch:       branch,
+			Commit:       commit,
+			Pusher:       "jdoe",
+			Provider:     "bitbucket",
+			Deleted:      deleted,
+		}
+	}
+	want := []types.DeploymentRequest{
+		request("main", "aaa111", false),
+		request("feature/login", "bbb222", false),
+		request("old-feature", "", true),
+	}
+
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("ParsePush =\n%+v\nwant\n%+v", requests, want)
+	}
+}
+
+func TestBitbucketParsePushErrors(t *testing.T) {
+	for _, body := range []string{
+		`not json`,
+		`{"repository": {"full_name": ""}, "push": {"changes": []}}`,
+		`{"repository": {"full_name": "no-owner"}, "push": {"changes": []}}`,
+	} {
+		if _, err := (Bitbucket{}).ParsePush([]byte(body)); err == nil {
+			t.Errorf("ParsePush(%s) accepted an invalid payload", body)
+		}
+	}
+}
+
+func TestBitbucketParsePushPusherFallback(t *testing.T) {
+	body := []byte(`{
+		"actor": {"display_name": "Jane Doe"},
+		"repository": {"full_name": "group/sub/app"},
+		"push": {"changes": [{"new": {"type": "branch", "name": "main", "target": {"hash": "aaa111"}}}]}
+	}`)
+
+	requests, err := Bitbucket{}.ParsePush(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Pusher != "Jane Doe" || requests[0].RepoOwner != "group/sub" || requests[0].RepoName != "app" {
+		t.Errorf("ParsePush = %+v", requests)
+	}
+}
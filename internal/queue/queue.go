@@ -0,0 +1,283 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// Status is where an entry is in the queue
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusRunning Status = "running"
+)
+
+// Entry is a push waiting to be deployed
+type Entry struct {
+	ID           string     `json:"id"`
+	Repo         string     `json:"repo"`
+	RepoOwner    string     `json:"repo_owner"`
+	RepoFullName string     `json:"repo_full_name"`
+	Branch       string     `json:"branch"`
+	Commit       string     `json:"commit"`
+	Pusher       string     `json:"pusher"`
+	Provider     string     `json:"provider,omitempty"`
+	Deleted      bool       `json:"deleted,omitempty"`
+	QueuedAt     time.Time  `json:"queued_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	Status       Status     `json:"status"`
+	// Pushes counts the pushes collapsed into this entry, only the newest commit is deployed
+	Pushes int `json:"pushes"`
+}
+
+// Request turns the entry back into the deployment it stands for
+func (e *Entry) Request() types.DeploymentRequest {
+	return types.DeploymentRequest{
+		RepoName:     e.Repo,
+		RepoOwner:    e.RepoOwner,
+		RepoFullName: e.RepoFullName,
+		Branch:       e.Branch,
+		Commit:       e.Commit,
+		Pusher:       e.Pusher,
+		Provider:     e.Provider,
+		Deleted:      e.Deleted,
+	}
+}
+
+// Queue keeps a JSON file of entries per repository under the state directory
+type Queue struct {
+	dir string
+}
+
+func New(stateDir string) *Queue {
+	return &Queue{
+		dir: filepath.Join(stateDir, "queue"),
+	}
+}
+
+func (q *Queue) path(repo string) string {
+	return filepath.Join(q.dir, repo+".json")
+}
+
+// Push adds a push to its repository's queue. A push to a branch that already has a pending
+// entry replaces that entry's commit, coalesced reports whether that happened. Deleting a
+// branch drops its pending deployments, there is nothing left to deploy
+func (q *Queue) Push(req types.DeploymentRequest) (entry *Entry, coalesced bool, err error) {
+	err = q.update(req.RepoName, func(entries []*Entry) ([]*Entry, error) {
+		if req.Deleted {
+			kept := entries[:0]
+			for _, existing := range entries {
+				if existing.Status == StatusPending && existing.Branch == req.Branch && !existing.Deleted {
+					continue
+				}
+				kept = append(kept, existing)
+			}
+			entries = kept
+		}
+
+		for _, existing := range entries {
+			if existing.Status == StatusPending && existing.Branch == req.Branch && existing.Deleted == req.Deleted {
+				existing.Commit = req.Commit
+				existing.Pusher = req.Pusher
+				existing.Pushes++
+				entry, coalesced = existing, true
+				return entries, nil
+			}
+		}
+
+		now := time.Now()
+		entry = &Entry{
+			ID:           now.Format("20060102_150405.000000"),
+			Repo:         req.RepoName,
+			RepoOwner:    req.RepoOwner,
+			RepoFullName: req.RepoFullName,
+			Branch:       req.Branch,
+			Commit:       req.Commit,
+			Pusher:       req.Pusher,
+			Provider:     req.Provider,
+			Deleted:      req.Deleted,
+			QueuedAt:     now,
+			Status:       StatusPending,
+			Pushes:       1,
+		}
+		return append(entries, entry), nil
+	})
+	return entry, coalesced, err
+}
+
+// Next marks the oldest pending entry of a repository as running, nil when nothing is pending
+func (q *Queue) Next(repo string) (*Entry, error) {
+	var next *Entry
+	err := q.update(repo, func(entries []*Entry) ([]*Entry, error) {
+		for _, entry := range entries {
+			if entry.Status == StatusPending {
+				now := time.Now()
+				entry.Status = StatusRunning
+				entry.StartedAt = &now
+				next = entry
+				break
+			}
+		}
+		return entries, nil
+	})
+	return next, err
+}
+
+// Done removes a finished entry
+func (q *Queue) Done(repo, id string) error {
+	return q.update(repo, func(entries []*Entry) ([]*Entry, error) {
+		return without(entries, id), nil
+	})
+}
+
+// Remove drops a pending entry so it is never deployed
+func (q *Queue) Remove(repo, id string) error {
+	return q.update(repo, func(entries []*Entry) ([]*Entry, error) {
+		for _, entry := range entries {
+			if entry.ID != id {
+				continue
+			}
+			if entry.Status != StatusPending {
+				return nil, fmt.Errorf("entry %s is already running", id)
+			}
+			return without(entries, id), nil
+		}
+		return nil, fmt.Errorf("no queued entry %s for %s", id, repo)
+	})
+}
+
+// Requeue puts entries left running by a stopped agent back in front of the queue
+func (q *Queue) Requeue(repo string) error {
+	return q.update(repo, func(entries []*Entry) ([]*Entry, error) {
+		for _, entry := range entries {
+			if entry.Status == StatusRunning {
+				entry.Status = StatusPending
+				entry.StartedAt = nil
+			}
+		}
+		return entries, nil
+	})
+}
+
+// List returns the entries of a repository, or of every repository when repo is empty, in queue order
+func (q *Queue) List(repo string) ([]*Entry, error) {
+	repos := []string{repo}
+	if repo == "" {
+		var err error
+		if repos, err = q.Repos(); err != nil {
+			return nil, err
+		}
+	}
+
+	var all []*Entry
+	for _, name := range repos {
+		entries, err := q.read(name)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+	}
+
+	return all, nil
+}
+
+// Repos returns the repositories that have a queue file
+func (q *Queue) Repos() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queues: %w", err)
+	}
+
+	repos := make([]string, 0, len(matches))
+	for _, path := range matches {
+		repos = append(repos, strings.TrimSuffix(filepath.Base(path), ".json"))
+	}
+	sort.Strings(repos)
+
+	return repos, nil
+}
+
+// read a repository's entries without locking, a missing file is an empty queue
+func (q *Queue) read(repo string) ([]*Entry, error) {
+	data, err := os.ReadFile(q.path(repo))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read queue of %s: %w", repo, err)
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse queue of %s: %w", repo, err)
+	}
+
+	return entries, nil
+}
+
+// change a repository's entries while holding its queue lock, writing them back atomically
+func (q *Queue) update(repo string, change func(entries []*Entry) ([]*Entry, error)) error {
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	lockFile, err := os.OpenFile(filepath.Join(q.dir, repo+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open queue lock: %w", err)
+	}
+	defer lockFile.Close()
+
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock queue: %w", err)
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	entries, err := q.read(repo)
+	if err != nil {
+		return err
+	}
+
+	entries, err = change(entries)
+	if err != nil {
+		return err
+	}
+
+	if entries == nil {
+		entries = []*Entry{}
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode queue: %w", err)
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", q.path(repo), os.Getpid())
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write queue: %w", err)
+	}
+	if err := os.Rename(tmp, q.path(repo)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write queue: %w", err)
+	}
+
+	return nil
+}
+
+func without(entries []*Entry, id string) []*Entry {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.ID != id {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,162 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+func push(t *testing.T, q *Queue, branch, commit string, deleted bool) (*Entry, bool) {
+	t.Helper()
+	entry, coalesced, err := q.Push(types.DeploymentRequest{
+		RepoName: "app",
+		Branch:   branch,
+		Commit:   commit,
+		Pusher:   "dev-" + commit,
+		Deleted:  deleted,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry, coalesced
+}
+
+func list(t *testing.T, q *Queue) []*Entry {
+	t.Helper()
+	entries, err := q.List("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestPushCoalescesPendingEntry(t *testing.T) {
+	q := New(t.TempDir())
+
+	first, coalesced := push(t, q, "main", "aaa", false)
+	if coalesced {
+		t.Fatal("the first push was coalesced")
+	}
+	other, _ := push(t, q, "develop", "bbb", false)
+	second, coalesced := push(t, q, "main", "ccc", false)
+	if !coalesced || second.ID != first.ID {
+		t.Fatalf("a push to a pending branch was not coalesced: %+v", second)
+	}
+
+	entries := list(t, q)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	main := entries[0]
+	if main.ID != first.ID || main.Commit != "ccc" || main.Pusher != "dev-ccc" || main.Pushes != 2 {
+		t.Errorf("the pending entry was not replaced: %+v", main)
+	}
+	if entries[1].ID != other.ID || entries[1].Commit != "bbb" || entries[1].Pushes != 1 {
+		t.Errorf("another branch's entry changed: %+v", entries[1])
+	}
+}
+
+func TestPushDoesNotReplaceRunningEntry(t *testing.T) {
+	q := New(t.TempDir())
+
+	push(t, q, "main", "aaa", false)
+	running, err := q.Next("app")
+	if err != nil || running == nil {
+		t.Fatalf("Next = %v, %v", running, err)
+	}
+
+	queued, coalesced := push(t, q, "main", "bbb", false)
+	if coalesced {
+		t.Fatal("a push was coalesced into the running entry")
+	}
+	again, coalesced := push(t, q, "main", "ccc", false)
+	if !coalesced || again.ID != queued.ID {
+		t.Fatal("a push was not coalesced into the entry queued behind the running one")
+	}
+
+	entries := list(t, q)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if entries[0].Status != StatusRunning || entries[0].Commit != "aaa" || entries[0].Pushes != 1 {
+		t.Errorf("the running entry changed: %+v", entries[0])
+	}
+	if entries[1].Status != StatusPending || entries[1].Commit != "ccc" || entries[1].Pushes != 2 {
+		t.Errorf("the pending entry is wrong: %+v", entries[1])
+	}
+}
+
+func TestPushDeletionDropsPendingEntries(t *testing.T) {
+	q := New(t.TempDir())
+
+	push(t, q, "feature", "aaa", false)
+	if _, err := q.Next("app"); err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, "feature", "bbb", false)
+	push(t, q, "main", "ccc", false)
+
+	deletion, coalesced := push(t, q, "feature", "", true)
+	if coalesced {
+		t.Fatal("a deletion was coalesced into a push")
+	}
+
+	entries := list(t, q)
+	want := []struct {
+		commit  string
+		status  Status
+		deleted bool
+	}{
+		{"aaa", StatusRunning, false},
+		{"ccc", StatusPending, false},
+		{"", StatusPending, true},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Commit != w.commit || e.Status != w.status || e.Deleted != w.deleted {
+			t.Errorf("entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+	if entries[2].ID != deletion.ID {
+		t.Errorf("the deletion is not last in the queue")
+	}
+
+	// A push after the deletion recreates the branch, it must not be merged into the deletion
+	if _, coalesced := push(t, q, "feature", "ddd", false); coalesced {
+		t.Error("a push was coalesced into a pending deletion")
+	}
+}
+
+func TestNextAndRequeue(t *testing.T) {
+	q := New(t.TempDir())
+
+	first, _ := push(t, q, "main", "aaa", false)
+	second, _ := push(t, q, "develop", "bbb", false)
+
+	next, err := q.Next("app")
+	if err != nil || next.ID != first.ID || next.StartedAt == nil {
+		t.Fatalf("Next = %+v, %v, want the oldest entry", next, err)
+	}
+	if err := q.Requeue("app"); err != nil {
+		t.Fatal(err)
+	}
+	if next, _ := q.Next("app"); next.ID != first.ID {
+		t.Errorf("a requeued entry lost its place: got %s, want %s", next.ID, first.ID)
+	}
+
+	if err := q.Remove("app", first.ID); err == nil {
+		t.Error("a running entry was removed")
+	}
+	if err := q.Done("app", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Remove("app", second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := q.Next("app"); err != nil || next != nil {
+		t.Errorf("Next of an empty queue = %+v, %v", next, err)
+	}
+}
@@ -0,0 +1,190 @@
+package release
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+)
+
+const (
+	releasesDirName = "releases"
+	currentLinkName = "current"
+)
+
+// Manager keeps every build in base/releases/<id> and serves one of them through the base/current symlink
+type Manager struct {
+	baseDir string
+	keep    int
+	log     *logger.Logger
+}
+
+func New(baseDir string, keep int, log *logger.Logger) *Manager {
+	return &Manager{
+		baseDir: baseDir,
+		keep:    keep,
+		log:     log,
+	}
+}
+
+// CurrentLink is the path nginx serves for a release base directory
+func CurrentLink(baseDir string) string {
+	return filepath.Join(baseDir, currentLinkName)
+}
+
+func (m *Manager) releasesDir() string {
+	return filepath.Join(m.baseDir, releasesDirName)
+}
+
+// Path returns the directory of a release
+func (m *Manager) Path(id string) string {
+	return filepath.Join(m.releasesDir(), id)
+}
+
+// Create copies a build into a new release, a failed copy never leaves a partial release behind
+func (m *Manager) Create(id, sourceDir string) (string, error) {
+	if err := os.MkdirAll(m.releasesDir(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create releases directory: %w", err)
+	}
+
+	releasePath := m.Path(id)
+	if _, err := os.Stat(releasePath); err == nil {
+		return "", fmt.Errorf("release %s already exists", id)
+	}
+
+	tmpPath := filepath.Join(m.releasesDir(), "."+id+".tmp")
+	os.RemoveAll(tmpPath)
+
+	m.log.Infof("Copying build to release %s...", id)
+	if err := os.MkdirAll(tmpPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create release directory: %w", err)
+	}
+
+	cmd := exec.Command("cp", "-r", sourceDir+"/.", tmpPath+"/")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return "", fmt.Errorf("copy failed: %w\nOutput: %s", err, string(output))
+	}
+
+	if err := os.Rename(tmpPath, releasePath); err != nil {
+		os.RemoveAll(tmpPath)
+		return "", fmt.Errorf("failed to finalize release: %w", err)
+	}
+
+	return releasePath, nil
+}
+
+// Activate atomically points the current symlink at a release
+func (m *Manager) Activate(id string) error {
+	if _, err := os.Stat(m.Path(id)); err != nil {
+		return fmt.Errorf("release %s not found: %w", id, err)
+	}
+
+	link := CurrentLink(m.baseDir)
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s exists and is not a symlink", link)
+	}
+
+	// rename(2) replaces the old link in one step, so nginx always sees a complete release
+	tmpLink := fmt.Sprintf("%s.%d.tmp", link, os.Getpid())
+	os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Join(releasesDirName, id), tmpLink); err != nil {
+		return fmt.Errorf("failed to create symlink: %w", err)
+	}
+
+	if err := os.Rename(tmpLink, link); err != nil {
+		os.Remove(tmpLink)
+		return fmt.Errorf("failed to switch current release: %w", err)
+	}
+
+	m.log.Successf("Current release: %s", id)
+	return nil
+}
+
+// Current returns the ID of the live release, or "" before the first release
+func (m *Manager) Current() (string, error) {
+	target, err := os.Readlink(CurrentLink(m.baseDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read current release: %w", err)
+	}
+
+	return filepath.Base(target), nil
+}
+
+// List returns the release IDs, oldest first
+func (m *Manager) List() ([]string, error) {
+	entries, err := os.ReadDir(m.releasesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list releases: %w", err)
+	}
+
+	// Release IDs are deployment IDs, which start with a timestamp
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			ids = append(ids, entry.Name())
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// Previous returns the newest release older than the current one, or "" when there is none
+func (m *Manager) Previous() (string, error) {
+	current, err := m.Current()
+	if err != nil || current == "" {
+		return "", err
+	}
+
+	ids, err := m.List()
+	if err != nil {
+		return "", err
+	}
+
+	previous := ""
+	for _, id := range ids {
+		if id >= current {
+			break
+		}
+		previous = id
+	}
+
+	return previous, nil
+}
+
+// Prune removes the oldest releases beyond the number to keep, never the current one or
+// previous, the release a rollback would go back to
+func (m *Manager) Prune(previous string) {
+	if m.keep <= 0 {
+		return
+	}
+
+	ids, err := m.List()
+	if err != nil || len(ids) <= m.keep {
+		return
+	}
+
+	current, _ := m.Current()
+	for _, id := range ids[:len(ids)-m.keep] {
+		if id == current || id == previous {
+			continue
+		}
+		if err := os.RemoveAll(m.Path(id)); err != nil {
+			m.log.Warningf("Failed to remove old release %s: %v", id, err)
+			continue
+		}
+		m.log.Infof("Removed old release: %s", id)
+	}
+}
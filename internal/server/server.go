@@ -0,0 +1,419 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/internal/config"
+	"github.com/Brayzonn/deploy-agent/internal/logger"
+	"github.com/Brayzonn/deploy-agent/internal/provider"
+	"github.com/Brayzonn/deploy-agent/internal/queue"
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// GitHub, the most generous of the providers, refuses to send payloads larger than 25 MB
+const maxPayloadSize = 25 << 20
+
+// how often expired previews are looked for
+const pruneInterval = 10 * time.Minute
+
+// Server receives push webhooks and works through each repository's deploy queue
+type Server struct {
+	cfg   *config.Config
+	log   *logger.Logger
+	agent string
+	queue *queue.Queue
+
+	mu       sync.Mutex
+	workers  map[string]bool
+	stopping bool
+	running  sync.WaitGroup
+}
+
+func New(cfg *config.Config, log *logger.Logger) (*Server, error) {
+	// Every deployment runs as its own `deploy-agent deploy` process with its own log and deployment ID
+	agent, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the deploy-agent binary: %w", err)
+	}
+
+	return &Server{
+		cfg:     cfg,
+		log:     log,
+		agent:   agent,
+		queue:   queue.New(cfg.StateDir),
+		workers: map[string]bool{},
+	}, nil
+}
+
+// Handler routes the webhook endpoints
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, name := range provider.Names() {
+		p, _ := provider.Get(name)
+		mux.HandleFunc("/webhook/"+name, s.webhookHandler(p))
+	}
+	// The path GitHub webhooks were set up with before other providers were supported
+	mux.HandleFunc("/githubwebhook", s.webhookHandler(provider.GitHub{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// ListenAndServe serves webhooks until SIGINT or SIGTERM, then waits for running deployments
+func (s *Server) ListenAndServe(addr string) error {
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+	}
+
+	if err := s.resumeQueues(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go s.prunePreviews(ctx)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		s.log.Infof("Listening for webhooks on %s", addr)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.log.Info("Shutting down, waiting for running deployments to finish...")
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.log.Warningf("Shutdown failed: %v", err)
+	}
+
+	s.running.Wait()
+	return nil
+}
+
+// handle the webhooks of one provider
+func (s *Server) webhookHandler(p provider.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxPayloadSize+1))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxPayloadSize {
+			http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		switch event := p.Event(r.Header); event {
+		case provider.EventPush:
+		case provider.EventPing:
+			respond(w, http.StatusOK, "pong", nil)
+			return
+		default:
+			respond(w, http.StatusAccepted, fmt.Sprintf("ignored %s event", event), nil)
+			return
+		}
+
+		requests, err := p.ParsePush(body)
+		if err != nil {
+			s.log.Warningf("Rejected %s push: %v", p.Name(), err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(requests) == 0 {
+			respond(w, http.StatusAccepted, "ignored push without a branch to deploy", nil)
+			return
+		}
+
+		// Verify every request before queueing any, a push is deployed completely or not at all
+		contexts := make([]*types.DeploymentContext, 0, len(requests))
+		for _, req := range requests {
+			ctx, err := s.verify(p, req, r.Header, body)
+			if errors.Is(err, config.ErrBranchNotMapped) {
+				s.log.Infof("Ignoring %s push: %v", p.Name(), err)
+				continue
+			}
+			if err == nil && ctx.Deleted && ctx.Config.Preview == nil {
+				s.log.Infof("Ignoring %s push: %s@%s was deleted", p.Name(), req.RepoFullName, req.Branch)
+				continue
+			}
+			if err != nil {
+				// Unknown repositories are answered like a bad signature so callers cannot probe which ones are configured
+				s.log.Warningf("Rejected %s push for %s: %v", p.Name(), req.RepoFullName, err)
+				http.Error(w, "signature verification failed", http.StatusUnauthorized)
+				return
+			}
+			contexts = append(contexts, ctx)
+		}
+
+		if len(contexts) == 0 {
+			respond(w, http.StatusAccepted, "ignored push to a branch without an environment", nil)
+			return
+		}
+
+		for _, ctx := range contexts {
+			if err := s.enqueue(ctx); err != nil {
+				s.log.Errorf("Failed to queue %s@%s: %v", ctx.RepoFullName, ctx.Branch, err)
+				http.Error(w, "failed to queue deployment", http.StatusInternalServerError)
+				return
+			}
+		}
+		respond(w, http.StatusAccepted, "queued", contexts[len(contexts)-1])
+	}
+}
+
+// check the webhook against the pushed repository's secret, then resolve the deployment it asks for
+func (s *Server) verify(p provider.Provider, req types.DeploymentRequest, header http.Header, body []byte) (*types.DeploymentContext, error) {
+	repoConfig, err := s.cfg.GetRepoConfig(req.RepoName, req.RepoOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := repoConfig.WebhookSecret
+	if secret == "" {
+		secret = s.cfg.WebhookSecret
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("no webhook_secret or DEPLOY_AGENT_WEBHOOK_SECRET configured")
+	}
+
+	if !p.Verify(secret, header, body) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	// Checked after the signature so only the repository's own host learns which branches are deployed
+	return config.NewDeploymentContext(s.cfg, req)
+}
+
+// add the push to its repository's queue and make sure a worker is draining it
+func (s *Server) enqueue(ctx *types.DeploymentContext) error {
+	req := types.DeploymentRequest{
+		RepoName:     ctx.RepoName,
+		RepoOwner:    ctx.RepoOwner,
+		RepoFullName: ctx.RepoFullName,
+		Branch:       ctx.Branch,
+		Commit:       ctx.Commit,
+		Pusher:       ctx.Pusher,
+		Provider:     ctx.Provider,
+		Deleted:      ctx.Deleted,
+	}
+	if req.Deleted {
+		// The "after" commit of a deletion is all zeros, there is nothing to deploy
+		req.Commit = ""
+	}
+
+	entry, coalesced, err := s.queue.Push(req)
+	if err != nil {
+		return err
+	}
+
+	if entry.Deleted {
+		s.log.Infof("Queued teardown of the %s@%s preview, deleted by %s, as %s", ctx.RepoFullName, ctx.Branch, ctx.Pusher, entry.ID)
+	} else if coalesced {
+		s.log.Infof("Coalesced %s@%s (%s) pushed by %s into queued entry %s (%d pushes)",
+			ctx.RepoFullName, ctx.Branch, ctx.ShortCommit(), ctx.Pusher, entry.ID, entry.Pushes)
+	} else {
+		s.log.Infof("Queued %s@%s (%s) pushed by %s as %s", ctx.RepoFullName, ctx.Branch, ctx.ShortCommit(), ctx.Pusher, entry.ID)
+	}
+
+	s.startWorker(ctx.RepoName)
+	return nil
+}
+
+// pick up the entries a previous run of the server left behind
+func (s *Server) resumeQueues() error {
+	repos, err := s.queue.Repos()
+	if err != nil {
+		return err
+	}
+
+	for _, repo := range repos {
+		// A deployment that was running when the agent stopped is deployed again
+		if err := s.queue.Requeue(repo); err != nil {
+			return err
+		}
+		if entries, err := s.queue.List(repo); err == nil && len(entries) > 0 {
+			s.log.Infof("Resuming %d queued deployment(s) of %s", len(entries), repo)
+			s.startWorker(repo)
+		}
+	}
+
+	return nil
+}
+
+// start a worker for a repository unless one is already running
+func (s *Server) startWorker(repo string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.workers[repo] || s.stopping {
+		return
+	}
+	s.workers[repo] = true
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		s.work(repo)
+	}()
+}
+
+// deploy a repository's queue one entry at a time until it is empty
+func (s *Server) work(repo string) {
+	for {
+		s.mu.Lock()
+		if s.stopping {
+			s.workers[repo] = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		entry, err := s.queue.Next(repo)
+		if err != nil {
+			s.log.Errorf("Failed to read the queue of %s: %v", repo, err)
+		}
+
+		if entry == nil {
+			// Checked under the lock so a push arriving now either sees this worker or starts a new one
+			s.mu.Lock()
+			if pending, _ := s.queue.List(repo); err != nil || !hasPending(pending) {
+				s.workers[repo] = false
+				s.mu.Unlock()
+				return
+			}
+			s.mu.Unlock()
+			continue
+		}
+
+		s.deploy(entry)
+
+		if err := s.queue.Done(repo, entry.ID); err != nil {
+			s.log.Errorf("Failed to remove %s from the queue of %s: %v", entry.ID, repo, err)
+		}
+	}
+}
+
+func hasPending(entries []*queue.Entry) bool {
+	for _, entry := range entries {
+		if entry.Status == queue.StatusPending {
+			return true
+		}
+	}
+	return false
+}
+
+// run a queued entry as its own deploy-agent deploy process
+func (s *Server) deploy(entry *queue.Entry) {
+	if entry.Deleted {
+		s.destroyPreview(entry)
+		return
+	}
+
+	commit := entry.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	s.log.Infof("Deploying %s@%s (%s), queue entry %s", entry.RepoFullName, entry.Branch, commit, entry.ID)
+
+	cmd := exec.Command(s.agent, "deploy",
+		"--repo", entry.Repo,
+		"--owner", entry.RepoOwner,
+		"--full-name", entry.RepoFullName,
+		"--branch", entry.Branch,
+		"--commit", entry.Commit,
+		"--pusher", entry.Pusher,
+		"--provider", entry.Provider,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		s.log.Errorf("Deployment of %s@%s (%s) failed: %v", entry.RepoFullName, entry.Branch, commit, err)
+		return
+	}
+	s.log.Successf("Deployment of %s@%s (%s) finished", entry.RepoFullName, entry.Branch, commit)
+}
+
+// tear down the preview of a deleted branch in its own deploy-agent preview process
+func (s *Server) destroyPreview(entry *queue.Entry) {
+	s.log.Infof("Destroying the preview of %s@%s, queue entry %s", entry.RepoFullName, entry.Branch, entry.ID)
+
+	cmd := exec.Command(s.agent, "preview", "destroy",
+		"--repo", entry.Repo,
+		"--branch", entry.Branch,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		s.log.Errorf("Teardown of the %s@%s preview failed: %v", entry.RepoFullName, entry.Branch, err)
+		return
+	}
+	s.log.Successf("Preview of %s@%s destroyed", entry.RepoFullName, entry.Branch)
+}
+
+// destroy the previews whose TTL ran out, every pruneInterval until ctx is done
+func (s *Server) prunePreviews(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cmd := exec.Command(s.agent, "preview", "prune")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			s.log.Warningf("Pruning expired previews failed: %v", err)
+		}
+	}
+}
+
+// write a small JSON answer for the webhook sender's delivery log
+func respond(w http.ResponseWriter, status int, message string, ctx *types.DeploymentContext) {
+	response := map[string]string{"status": message}
+	if ctx != nil {
+		response["repository"] = ctx.RepoFullName
+		response["branch"] = ctx.Branch
+		response["commit"] = ctx.Commit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
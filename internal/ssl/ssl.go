@@ -2,6 +2,7 @@ package ssl
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 
@@ -83,6 +84,24 @@ func (s *SSLManager) RenewCertificate() error {
 	return nil
 }
 
+// DeleteCertificate revokes nothing, it only removes the domain's certificate so certbot stops renewing it
+func (s *SSLManager) DeleteCertificate() error {
+	if _, err := os.Stat(fmt.Sprintf("/etc/letsencrypt/live/%s", s.domain)); os.IsNotExist(err) {
+		return nil
+	}
+
+	s.log.Infof("Deleting SSL certificate of %s...", s.domain)
+
+	cmd := exec.Command("sudo", "certbot", "delete", "--non-interactive", "--cert-name", s.domain)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to delete certificate: %w\nOutput: %s", err, string(output))
+	}
+
+	s.log.Success("SSL certificate deleted")
+	return nil
+}
+
 func (s *SSLManager) Setup() error {
 	return s.RequestCertificate()
 }
\ No newline at end of file
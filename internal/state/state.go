@@ -0,0 +1,223 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Brayzonn/deploy-agent/pkg/types"
+)
+
+// Result is the final outcome of a deployment
+type Result string
+
+const (
+	ResultRunning    Result = "running"
+	ResultSuccess    Result = "success"
+	ResultFailed     Result = "failed"
+	ResultUpToDate   Result = "up_to_date"
+	ResultSuperseded Result = "superseded"
+
+	// ResultSkipped, ResultUnchanged and ResultReverted are only given to the components of a
+	// deployment: those left out after another failed, those with nothing changed and those put
+	// back on what ran before after another failed
+	ResultSkipped   Result = "skipped"
+	ResultUnchanged Result = "unchanged"
+	ResultReverted  Result = "reverted"
+)
+
+// ComponentResult is the outcome of one component of a monorepo deployment
+type ComponentResult struct {
+	Name   string `json:"name"`
+	Result Result `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Transition is a DeploymentState the deployment entered and when
+type Transition struct {
+	State types.DeploymentState `json:"state"`
+	At    time.Time             `json:"at"`
+}
+
+// Record is the durable history of one deployment
+type Record struct {
+	DeploymentID    string     `json:"deployment_id"`
+	Repo            string     `json:"repo"`
+	Environment     string     `json:"environment,omitempty"`
+	RepoFullName    string     `json:"repo_full_name"`
+	Branch          string     `json:"branch"`
+	RequestedCommit string     `json:"requested_commit"`
+	DeployedCommit  string     `json:"deployed_commit,omitempty"`
+	Pusher          string     `json:"pusher"`
+	Forced          bool       `json:"forced,omitempty"`
+	LogFile         string     `json:"log_file,omitempty"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	Result          Result     `json:"result"`
+	Error           string     `json:"error,omitempty"`
+	RolledBackTo    string     `json:"rolled_back_to,omitempty"`
+	// Components is set for monorepos, in the order they were deployed
+	Components  []ComponentResult `json:"components,omitempty"`
+	Transitions []Transition      `json:"transitions"`
+}
+
+// Store keeps deployment records as JSON files under the state directory
+type Store struct {
+	dir string
+}
+
+func NewStore(stateDir string) *Store {
+	return &Store{
+		dir: filepath.Join(stateDir, "deployments"),
+	}
+}
+
+// NewRecord starts the record of a deployment
+func NewRecord(ctx *types.DeploymentContext, logFile string) *Record {
+	return &Record{
+		DeploymentID:    ctx.DeploymentID,
+		Repo:            ctx.RepoName,
+		Environment:     ctx.Config.Environment,
+		RepoFullName:    ctx.RepoFullName,
+		Branch:          ctx.Branch,
+		RequestedCommit: ctx.Commit,
+		Pusher:          ctx.Pusher,
+		Forced:          ctx.Force,
+		LogFile:         logFile,
+		StartedAt:       ctx.StartTime,
+		Result:          ResultRunning,
+		Transitions:     []Transition{},
+	}
+}
+
+// AddTransition appends a state change to the record
+func (r *Record) AddTransition(state types.DeploymentState) {
+	r.Transitions = append(r.Transitions, Transition{State: state, At: time.Now()})
+}
+
+// Finish sets the final result of the record
+func (r *Record) Finish(result Result, err error) {
+	now := time.Now()
+	r.FinishedAt = &now
+	r.Result = result
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// where a deployment's record is written
+func (s *Store) path(repo, deploymentID string) string {
+	return filepath.Join(s.dir, repo, deploymentID+".json")
+}
+
+// Save writes the record atomically so a crash never leaves a half written file
+func (s *Store) Save(record *Record) error {
+	path := s.path(record.Repo, record.DeploymentID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode deployment record: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".record-*")
+	if err != nil {
+		return fmt.Errorf("failed to write deployment record: %w", err)
+	}
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write deployment record: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write deployment record: %w", err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write deployment record: %w", err)
+	}
+
+	return nil
+}
+
+// Load reads a single deployment record
+func (s *Store) Load(repo, deploymentID string) (*Record, error) {
+	data, err := os.ReadFile(s.path(repo, deploymentID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deployment record: %w", err)
+	}
+
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse deployment record %s: %w", deploymentID, err)
+	}
+
+	return &record, nil
+}
+
+// List returns the records of a repository, or of every repository when repo is empty, newest first
+func (s *Store) List(repo string) ([]*Record, error) {
+	pattern := filepath.Join(s.dir, "*", "*.json")
+	if repo != "" {
+		pattern = filepath.Join(s.dir, repo, "*.json")
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployment records: %w", err)
+	}
+
+	records := make([]*Record, 0, len(matches))
+	for _, path := range matches {
+		deploymentID := strings.TrimSuffix(filepath.Base(path), ".json")
+		record, err := s.Load(filepath.Base(filepath.Dir(path)), deploymentID)
+		if err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartedAt.After(records[j].StartedAt)
+	})
+
+	return records, nil
+}
+
+// Find returns the record of a deployment ID in any repository
+func (s *Store) Find(deploymentID string) (*Record, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*", deploymentID+".json"))
+	if err != nil || len(matches) == 0 {
+		return nil, fmt.Errorf("no deployment record for %s", deploymentID)
+	}
+
+	return s.Load(filepath.Base(filepath.Dir(matches[0])), deploymentID)
+}
+
+// LastSuccessful returns the most recent deployment of a repository's environment that went live, or nil
+func (s *Store) LastSuccessful(repo, environment string) (*Record, error) {
+	records, err := s.List(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		if record.Result == ResultSuccess && record.Environment == environment {
+			return record, nil
+		}
+	}
+
+	return nil, nil
+}
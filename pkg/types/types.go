@@ -1,6 +1,11 @@
 package types
 
-import "time"
+import (
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
 
 type ProjectType string
 
@@ -15,39 +20,303 @@ type DeploymentState string
 
 const (
 	StateStarting        DeploymentState = "STARTING"
+	StateWaitingForLock  DeploymentState = "WAITING_FOR_LOCK"
+	StateSuperseded      DeploymentState = "SUPERSEDED"
 	StateFetching        DeploymentState = "FETCHING"
 	StatePulling         DeploymentState = "PULLING"
+	StateForced          DeploymentState = "FORCED_DEPLOY"
 	StateDeployingServer DeploymentState = "DEPLOYING_SERVER"
 	StateDeployingClient DeploymentState = "DEPLOYING_CLIENT"
 	StateDeployingFull   DeploymentState = "DEPLOYING_FULLSTACK"
 	StateBuildingDocker  DeploymentState = "BUILDING_DOCKER"      
 	StateDeployingDocker DeploymentState = "DEPLOYING_DOCKER"     
 	StateRunningMigrations DeploymentState = "RUNNING_MIGRATIONS" 
+	StateRollingBack     DeploymentState = "ROLLING_BACK"
 	StateSuccess         DeploymentState = "SUCCESS"
 	StateFailed          DeploymentState = "FAILED"
 )
 
 type RepoConfig struct {
-	Name          string
-	RepoDir       string
-	WebRoot       string
-	ProjectType   ProjectType
-	FullStack     bool
-	ClientDir     string
-	ServerDir     string
-	ServerEntry   string
-	PM2Ecosystem  string
-	Domain        string   
-	DomainAliases []string 
-	Port          int      
-
-    UseDocker          bool   
-	DockerComposeFile  string 
-	DockerEnvFile      string 
-	RequiresMigrations bool   
-	MigrationCommand   string 
-	HealthCheckURL     string 
-	HealthCheckTimeout int    
+	Name          string      `yaml:"name"`
+	Branch        string      `yaml:"branch"`
+	RepoDir       string      `yaml:"repo_dir"`
+	WebRoot       string      `yaml:"web_root"`
+	ProjectType   ProjectType `yaml:"project_type"`
+	FullStack     bool        `yaml:"full_stack"`
+	ClientDir     string      `yaml:"client_dir"`
+	ServerDir     string      `yaml:"server_dir"`
+	ServerEntry   string      `yaml:"server_entry"`
+	PM2Ecosystem  string      `yaml:"pm2_ecosystem"`
+	PM2AppName    string      `yaml:"pm2_app_name"`
+	Domain        string      `yaml:"domain"`
+	DomainAliases []string    `yaml:"domain_aliases"`
+	Port          int         `yaml:"port"`
+
+	// The server half of a fullstack repository is served at ServerDomain, api.<domain> when it is
+	// left out, or under APIPath of the client's domain. ServerPort defaults to port
+	ServerDomain         string   `yaml:"server_domain"`
+	ServerDomainAliases  []string `yaml:"server_domain_aliases"`
+	ServerPort           int      `yaml:"server_port"`
+	ServerHealthCheckURL string   `yaml:"server_health_check_url"`
+	APIPath              string   `yaml:"api_path"`
+
+	// ClientPaths and ServerPaths are globs of files outside client_dir and server_dir whose
+	// changes redeploy that half of a fullstack repository
+	ClientPaths []string `yaml:"client_paths"`
+	ServerPaths []string `yaml:"server_paths"`
+
+	UseDocker          bool   `yaml:"use_docker"`
+	DockerComposeFile  string `yaml:"docker_compose_file"`
+	DockerEnvFile      string `yaml:"docker_env_file"`
+	RequiresMigrations bool   `yaml:"requires_migrations"`
+	MigrationCommand   string `yaml:"migration_command"`
+	HealthCheckURL     string `yaml:"health_check_url"`
+	HealthCheckTimeout int    `yaml:"health_check_timeout"`
+	KeepReleases       int    `yaml:"keep_releases"`
+
+	// Test lists commands that must pass between the build and the switch, .deploy.yml can replace them
+	Test []string `yaml:"test"`
+
+	LockPolicy    string `yaml:"lock_policy"`
+	WebhookSecret string `yaml:"webhook_secret"`
+
+	Provider      string `yaml:"provider"`
+	GitHost       string `yaml:"git_host"`
+	CloneProtocol string `yaml:"clone_protocol"`
+	CloneURL      string `yaml:"clone_url"`
+
+	Environments []Environment  `yaml:"environments"`
+	Previews     *PreviewConfig `yaml:"previews"`
+	Hooks        Hooks          `yaml:"hooks"`
+	// Components are the apps of a monorepo, each deployed like a repository of its own
+	Components []Component `yaml:"components"`
+	// Environment is the environment this config was resolved for, empty for repositories without environments
+	Environment string `yaml:"-"`
+	// Preview is set when the config was resolved for a preview environment
+	Preview *Preview `yaml:"-"`
+	// Component is the component this config was resolved for, empty outside monorepos
+	Component string `yaml:"-"`
+}
+
+// Target names what a deployment of this config replaces: the repository, or repository.environment
+func (c *RepoConfig) Target() string {
+	if c.Environment == "" {
+		return c.Name
+	}
+	return c.Name + "." + c.Environment
+}
+
+// FullstackServer returns the config the server half of a fullstack repository is deployed with:
+// a copy with the server's domain, aliases, port and health check in place of the client's
+func (c *RepoConfig) FullstackServer() *RepoConfig {
+	server := *c
+	server.DomainAliases = nil
+
+	switch {
+	case c.APIPath != "":
+		// The client's site proxies the path, the server has no site of its own
+		server.Domain = ""
+	case c.ServerDomain != "":
+		server.Domain = c.ServerDomain
+		server.DomainAliases = c.ServerDomainAliases
+	default:
+		// Without either the server has no site, it is only reached on its port
+		server.Domain = ""
+	}
+
+	if c.ServerPort != 0 {
+		server.Port = c.ServerPort
+	}
+
+	switch {
+	case c.ServerHealthCheckURL != "":
+		server.HealthCheckURL = c.ServerHealthCheckURL
+	case c.APIPath != "" && c.HealthCheckURL == "" && server.Port != 0:
+		// The client's site only proxies the path once the client is switched, after the server
+		server.HealthCheckURL = "http://localhost:" + strconv.Itoa(server.Port) + c.APIPath
+	}
+
+	return &server
+}
+
+// Environment is a deployment target of a repository chosen by the pushed branch,
+// fields left empty fall back to the repository's own values
+type Environment struct {
+	Name                string   `yaml:"name"`
+	Branches            []string `yaml:"branches"`
+	RepoDir             string   `yaml:"repo_dir"`
+	WebRoot             string   `yaml:"web_root"`
+	Domain              string   `yaml:"domain"`
+	DomainAliases       []string `yaml:"domain_aliases"`
+	Port                int      `yaml:"port"`
+	ServerDomain        string   `yaml:"server_domain"`
+	ServerDomainAliases []string `yaml:"server_domain_aliases"`
+	ServerPort          int      `yaml:"server_port"`
+	PM2AppName          string   `yaml:"pm2_app_name"`
+	DockerComposeFile   string   `yaml:"docker_compose_file"`
+	DockerEnvFile       string   `yaml:"docker_env_file"`
+}
+
+// Component is one app of a monorepo with its own directory, web root or PM2 app and domain.
+// Fields left empty are not taken from the repository, two components never share them
+type Component struct {
+	Name          string      `yaml:"name"`
+	ProjectType   ProjectType `yaml:"project_type"`
+	Dir           string      `yaml:"dir"`
+	// DependsOn names the components that are deployed before this one
+	DependsOn []string `yaml:"depends_on"`
+	// Paths are globs of files outside dir whose changes redeploy the component
+	Paths              []string `yaml:"paths"`
+	WebRoot            string   `yaml:"web_root"`
+	KeepReleases       int      `yaml:"keep_releases"`
+	ServerEntry        string   `yaml:"server_entry"`
+	PM2Ecosystem       string   `yaml:"pm2_ecosystem"`
+	PM2AppName         string   `yaml:"pm2_app_name"`
+	Domain             string   `yaml:"domain"`
+	DomainAliases      []string `yaml:"domain_aliases"`
+	Port               int      `yaml:"port"`
+	HealthCheckURL     string   `yaml:"health_check_url"`
+	HealthCheckTimeout int      `yaml:"health_check_timeout"`
+}
+
+// PreviewConfig deploys matching branches to short-lived environments at <branch-slug>.<domain>
+type PreviewConfig struct {
+	Branches []string `yaml:"branches"`
+	Domain   string   `yaml:"domain"`
+	Dir      string   `yaml:"dir"`
+	WebRoot  string   `yaml:"web_root"`
+	TTL      string   `yaml:"ttl"`
+	PortMin  int      `yaml:"port_min"`
+	PortMax  int      `yaml:"port_max"`
+}
+
+// Preview identifies the preview environment of one branch
+type Preview struct {
+	Branch string
+	Slug   string
+	// BaseDir is the checkout the preview's worktree is added to
+	BaseDir string
+	// BaseTarget is the deployment target whose lock guards BaseDir
+	BaseTarget string
+	// Project is the docker compose project name of the preview
+	Project string
+	TTL     time.Duration
+	PortMin int
+	PortMax int
+}
+
+// Pipeline is how a directory of the repository is built and checked, from the .deploy.yml the
+// application keeps next to its package.json. Empty fields keep the agent's built-in behaviour
+type Pipeline struct {
+	Install     string              `yaml:"install"`
+	Build       string              `yaml:"build"`
+	Test        []string            `yaml:"test"`
+	OutputDir   string              `yaml:"output_dir"`
+	Env         map[string]string   `yaml:"env"`
+	Hooks       Hooks               `yaml:"hooks"`
+	HealthCheck PipelineHealthCheck `yaml:"health_check"`
+}
+
+// PipelineHealthCheck overrides the repository's health_check_url and health_check_timeout
+type PipelineHealthCheck struct {
+	URL     string `yaml:"url"`
+	Timeout int    `yaml:"timeout"`
+}
+
+// HookStage is a point of the deployment where hooks run
+type HookStage string
+
+const (
+	HookBeforeFetch  HookStage = "before_fetch"
+	HookAfterPull    HookStage = "after_pull"
+	HookBeforeBuild  HookStage = "before_build"
+	HookAfterBuild   HookStage = "after_build"
+	HookBeforeSwitch HookStage = "before_switch"
+	HookAfterSwitch  HookStage = "after_switch"
+	HookOnSuccess    HookStage = "on_success"
+	HookOnFailure    HookStage = "on_failure"
+)
+
+// Hook is a shell command run at a stage of the deployment, written as the command alone or with options
+type Hook struct {
+	Run     string `yaml:"run"`
+	Timeout string `yaml:"timeout"`
+	// ContinueOnError logs a failure instead of aborting the deployment
+	ContinueOnError bool `yaml:"continue_on_error"`
+}
+
+func (h *Hook) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&h.Run)
+	}
+
+	type plain Hook
+	return node.Decode((*plain)(h))
+}
+
+// Hooks are the commands run at each stage of a deployment
+type Hooks struct {
+	BeforeFetch  []Hook `yaml:"before_fetch"`
+	AfterPull    []Hook `yaml:"after_pull"`
+	BeforeBuild  []Hook `yaml:"before_build"`
+	AfterBuild   []Hook `yaml:"after_build"`
+	BeforeSwitch []Hook `yaml:"before_switch"`
+	AfterSwitch  []Hook `yaml:"after_switch"`
+	OnSuccess    []Hook `yaml:"on_success"`
+	OnFailure    []Hook `yaml:"on_failure"`
+	// PreDeploy and PostDeploy are older names of before_switch and on_success
+	PreDeploy  []Hook `yaml:"pre_deploy"`
+	PostDeploy []Hook `yaml:"post_deploy"`
+	// Timeout applies to hooks without a timeout of their own
+	Timeout string `yaml:"timeout"`
+}
+
+// For returns the hooks of a stage with the default timeout filled in
+func (h *Hooks) For(stage HookStage) []Hook {
+	var hooks []Hook
+	switch stage {
+	case HookBeforeFetch:
+		hooks = h.BeforeFetch
+	case HookAfterPull:
+		hooks = h.AfterPull
+	case HookBeforeBuild:
+		hooks = h.BeforeBuild
+	case HookAfterBuild:
+		hooks = h.AfterBuild
+	case HookBeforeSwitch:
+		hooks = append(append(hooks, h.PreDeploy...), h.BeforeSwitch...)
+	case HookAfterSwitch:
+		hooks = h.AfterSwitch
+	case HookOnSuccess:
+		hooks = append(append(hooks, h.OnSuccess...), h.PostDeploy...)
+	case HookOnFailure:
+		hooks = h.OnFailure
+	}
+
+	resolved := make([]Hook, len(hooks))
+	for i, hook := range hooks {
+		if hook.Timeout == "" {
+			hook.Timeout = h.Timeout
+		}
+		resolved[i] = hook
+	}
+	return resolved
+}
+
+// DeploymentRequest is a push to deploy, before its repo config has been resolved
+type DeploymentRequest struct {
+	RepoName     string
+	Branch       string
+	RepoOwner    string
+	Pusher       string
+	Commit       string
+	RepoFullName string
+	Provider     string
+	Force        bool
+	// CleanInstall removes node_modules and installs even when the dependencies did not change
+	CleanInstall bool
+	// Deleted is set for pushes that deleted the branch
+	Deleted bool
 }
 
 type DeploymentContext struct {
@@ -60,6 +329,22 @@ type DeploymentContext struct {
 	DeploymentID  string
 	StartTime     time.Time
 	Config        *RepoConfig
+	LockPolicy    string
+	Provider      string
+	Force         bool
+	CleanInstall  bool
+	Deleted       bool
+}
+
+// ShortCommit returns the abbreviated commit, or "latest" when no commit was requested
+func (c *DeploymentContext) ShortCommit() string {
+	if c.Commit == "" {
+		return "latest"
+	}
+	if len(c.Commit) > 7 {
+		return c.Commit[:7]
+	}
+	return c.Commit
 }
 
 type BuildOutput struct {
@@ -75,4 +360,4 @@ type DockerDeploymentResult struct {
 	MigrationsRun     bool
 	HealthCheckPassed bool
 	Logs              string
-}
\ No newline at end of file
+}